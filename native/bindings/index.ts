@@ -2,6 +2,7 @@ import { spawn } from 'child_process';
 import { join, dirname } from 'path';
 import { existsSync } from 'fs';
 import { fileURLToPath } from 'url';
+import { encode, decode } from './msgpack';
 
 const binaryName = process.platform === 'win32'
   ? 'nubodb-native.exe'
@@ -42,6 +43,130 @@ const binaryPath = findBinaryPath();
 let processInstance: any = null;
 let isAvailable = binaryPath !== null && existsSync(binaryPath);
 
+const FRAME_HEADER_SIZE = 8;
+const MAX_FRAME_SIZE = 256 * 1024 * 1024;
+
+interface PendingCall {
+  resolve: (value: any) => void;
+  reject: (reason: Error) => void;
+  /** Receives the partial responses of a streamed result */
+  onPartial?: (part: any) => void;
+}
+
+let nextRequestId = 1;
+const pendingCalls = new Map<number, PendingCall>();
+let stdoutBuffer = Buffer.alloc(0);
+let framed = false;
+let binary = false;
+let handshakeId = 0;
+let handshake: Promise<void> | null = null;
+
+/** Error returned by the sidecar. `code` and `details` are set for errors the
+ * caller can act on, such as `DUPLICATE_KEY`. */
+export class NativeError extends Error {
+  constructor(
+    message: string,
+    public code?: string,
+    public details?: unknown
+  ) {
+    super(message);
+    this.name = 'NativeError';
+  }
+}
+
+/** Details of a `DUPLICATE_KEY` error */
+export interface DuplicateKeyDetails {
+  index: string;
+  key: unknown;
+  id: string;
+  conflictingId: string;
+}
+
+function rejectPendingCalls(reason: Error) {
+  for (const pending of pendingCalls.values()) {
+    pending.reject(reason);
+  }
+  pendingCalls.clear();
+}
+
+function handleResponse(payload: Buffer) {
+  let response: any;
+  try {
+    response = binary ? decode(payload) : JSON.parse(payload.toString());
+  } catch {
+    return;
+  }
+
+  // Everything after the handshake response uses the negotiated framing and
+  // encoding.
+  if (response.id === handshakeId && response.result) {
+    framed = response.result.framing === 'length';
+    binary = response.result.encoding === 'msgpack';
+  }
+
+  const pending = pendingCalls.get(response.id);
+  if (!pending) {
+    return;
+  }
+  if (response.partial) {
+    pending.onPartial?.(response.result);
+    return;
+  }
+  pendingCalls.delete(response.id);
+
+  if (response.error) {
+    pending.reject(new NativeError(response.error, response.code, response.details));
+  } else {
+    pending.resolve(response.result);
+  }
+}
+
+function drainStdout() {
+  while (stdoutBuffer.length > 0) {
+    if (framed) {
+      if (stdoutBuffer.length < FRAME_HEADER_SIZE) {
+        return;
+      }
+      const size = stdoutBuffer.readUInt32BE(0);
+      if (stdoutBuffer.length < FRAME_HEADER_SIZE + size) {
+        return;
+      }
+      const payload = stdoutBuffer.subarray(
+        FRAME_HEADER_SIZE,
+        FRAME_HEADER_SIZE + size
+      );
+      stdoutBuffer = stdoutBuffer.subarray(FRAME_HEADER_SIZE + size);
+      handleResponse(payload);
+    } else {
+      const newline = stdoutBuffer.indexOf(0x0a);
+      if (newline < 0) {
+        return;
+      }
+      const line = stdoutBuffer.subarray(0, newline);
+      stdoutBuffer = stdoutBuffer.subarray(newline + 1);
+      if (line.toString().trim()) {
+        handleResponse(line);
+      }
+    }
+  }
+}
+
+function encodeRequest(request: Record<string, any>): Buffer {
+  return binary ? encode(request) : Buffer.from(JSON.stringify(request));
+}
+
+function writeRequest(proc: any, id: number, body: Buffer) {
+  if (!framed) {
+    proc.stdin.write(Buffer.concat([body, Buffer.from('\n')]));
+    return;
+  }
+
+  const header = Buffer.alloc(FRAME_HEADER_SIZE);
+  header.writeUInt32BE(body.length, 0);
+  header.writeUInt32BE(id, 4);
+  proc.stdin.write(Buffer.concat([header, body]));
+}
+
 function getProcess() {
   if (processInstance && !processInstance.killed) {
     return processInstance;
@@ -57,14 +182,25 @@ function getProcess() {
       stdio: ['pipe', 'pipe', 'pipe'],
     });
 
-    processInstance.on('error', () => {
+    stdoutBuffer = Buffer.alloc(0);
+    framed = false;
+    binary = false;
+    handshake = null;
+    processInstance.stdout.on('data', (data: Buffer) => {
+      stdoutBuffer = Buffer.concat([stdoutBuffer, data]);
+      drainStdout();
+    });
+
+    processInstance.on('error', (err: Error) => {
       processInstance = null;
       isAvailable = false;
+      rejectPendingCalls(err);
     });
 
     processInstance.on('exit', () => {
       processInstance = null;
       isAvailable = false;
+      rejectPendingCalls(new Error('Go binary exited'));
     });
 
     isAvailable = true;
@@ -75,60 +211,181 @@ function getProcess() {
   }
 }
 
-function callMethod(method: string, params: Record<string, any>): Promise<any> {
+function negotiate(proc: any): Promise<void> {
+  if (!handshake) {
+    handshake = new Promise<void>((resolve, reject) => {
+      handshakeId = nextRequestId++;
+      pendingCalls.set(handshakeId, { resolve: () => resolve(), reject });
+      writeRequest(
+        proc,
+        handshakeId,
+        encodeRequest({
+          id: handshakeId,
+          method: 'handshake',
+          params: {
+            framing: 'length',
+            encoding: 'msgpack',
+            maxFrameSize: MAX_FRAME_SIZE,
+          },
+        })
+      );
+    });
+  }
+  return handshake;
+}
+
+async function callMethod(
+  method: string,
+  params: Record<string, any>,
+  onPartial?: (part: any) => void
+): Promise<any> {
+  const proc = getProcess();
+  if (!proc) {
+    throw new Error('Go binary not available');
+  }
+
+  await negotiate(proc);
+
+  const id = nextRequestId++;
+  const payload = encodeRequest({ id, method, params });
+  if (payload.length > MAX_FRAME_SIZE) {
+    throw new Error(
+      `Request of ${payload.length} bytes exceeds max frame size of ${MAX_FRAME_SIZE} bytes`
+    );
+  }
+
   return new Promise((resolve, reject) => {
-    const proc = getProcess();
-    if (!proc) {
-      reject(new Error('Go binary not available'));
-      return;
-    }
+    pendingCalls.set(id, { resolve, reject, onPartial });
+    writeRequest(proc, id, payload);
+  });
+}
 
-    const request = {
-      method,
-      params,
-    };
-
-    let stdout = '';
-    const onData = (data: Buffer) => {
-      stdout += data.toString();
-      const lines = stdout.split('\n');
-      stdout = lines.pop() || '';
-
-      for (const line of lines) {
-        if (line.trim()) {
-          try {
-            const response = JSON.parse(line);
-            proc.stdout.removeListener('data', onData);
-            if (response.error) {
-              reject(new Error(response.error));
-            } else {
-              resolve(response.result);
-            }
-          } catch (err) {
-            proc.stdout.removeListener('data', onData);
-            reject(err);
-          }
-        }
-      }
-    };
+// The sidecar only sees an object's key order while it is JSON text, so sort
+// specs are always sent as [field, direction] pairs.
+function sortPairs(sort: SortSpec): Array<[string, 1 | -1]> {
+  return Array.isArray(sort) ? sort : Object.entries(sort);
+}
 
-    proc.stdout.on('data', onData);
-    proc.stdin.write(JSON.stringify(request) + '\n');
+// sortStream calls sortDocuments and puts back together a result that came
+// in parts, or hands each part to onChunk.
+async function sortStream(
+  params: Record<string, any>,
+  { onChunk, ...options }: SortOptions
+): Promise<any[]> {
+  const collected: any[] = [];
+  const receive = (documents: any[] = []) => {
+    if (onChunk) {
+      onChunk(documents);
+    } else {
+      collected.push(...documents);
+    }
+  };
+
+  const result: SortResult = await callMethod(
+    'sortDocuments',
+    { ...params, ...options },
+    (part: SortResult) => receive(part.results)
+  );
+  if (result.error) {
+    throw new Error(result.error);
+  }
+  receive(result.results);
+  return collected;
+}
+
+// Keys are sent as JSON text so the sidecar can tell the string "5" from the
+// number 5. Dates become {"$date": ...} rather than bare timestamp strings. A
+// missing value is keyed like null, which is also how it reaches a compound
+// key through JSON.stringify.
+function indexKeyString(key: unknown): string {
+  if (key === undefined) {
+    return 'null';
+  }
+  return JSON.stringify(key, function (this: any, name: string, value: unknown) {
+    const raw = this[name];
+    return raw instanceof Date && !isNaN(raw.getTime())
+      ? { $date: raw.toISOString() }
+      : value;
   });
 }
 
+function indexKeyStrings(keys: Record<string, unknown>): Record<string, string> {
+  const result: Record<string, string> = {};
+  for (const [indexName, key] of Object.entries(keys)) {
+    result[indexName] = indexKeyString(key);
+  }
+  return result;
+}
+
+/** Identifies a collection, optionally qualified by its database path.
+ * Indexes and resident documents are both kept per scope. */
+export interface IndexScope {
+  collection: string;
+  database?: string;
+}
+
+/** A resident collection, by name or by scope */
+export type CollectionRef = string | IndexScope;
+
+function scopeOf(collection: CollectionRef): IndexScope {
+  return typeof collection === 'string' ? { collection } : collection;
+}
+
+/** State of a collection's document files when a snapshot was taken */
+export interface CollectionMarker {
+  documents: number;
+  lastModified: string | null;
+}
+
+export interface IndexSnapshotResult {
+  loaded?: boolean;
+  stale?: boolean;
+  path?: string;
+  indexes?: string[];
+  bytes?: number;
+  marker?: CollectionMarker;
+  current?: CollectionMarker;
+}
+
 export interface FilterResult {
   results?: any[];
   error?: string;
 }
 
+/** How the sidecar found candidate ids */
+export interface QueryPlan {
+  strategy: 'index' | 'intersection' | 'union' | 'scan';
+  indexes?: string[];
+  estimatedCount: number;
+  candidateCount: number;
+}
+
 export interface CandidateIdsResult {
   ids?: string[];
+  plan?: QueryPlan;
   error?: string;
 }
 
+export interface SortOptions {
+  skip?: number;
+  limit?: number;
+  /** Bytes of documents to sort in memory; past it, sorted runs are spilled
+   * to temporary files and merged. It bounds each run and each part of the
+   * output, not the sidecar's memory: the input is decoded in full first. */
+  memoryBudget?: number;
+  /** Where spilled runs are written; the OS temp directory by default */
+  tempDir?: string;
+  /** Receives a spilled sort's output in order, part by part. When set, the
+   * sort resolves to an empty array instead of collecting the parts. */
+  onChunk?: (documents: any[]) => void;
+}
+
 export interface SortResult {
   results?: any[];
+  /** `none`, `full`, `topK` or `external` */
+  strategy?: string;
+  /** Number of runs merged by an `external` sort */
+  runs?: number;
   error?: string;
 }
 
@@ -137,6 +394,55 @@ export interface ProjectResult {
   error?: string;
 }
 
+/** Sort fields in order of precedence, as an object or as pairs */
+export type SortSpec = Record<string, 1 | -1> | Array<[string, 1 | -1]>;
+
+export interface QueryParams {
+  sort?: SortSpec;
+  skip?: number;
+  limit?: number;
+  projection?: Record<string, 0 | 1>;
+  /** Database path the collection's indexes were loaded under */
+  database?: string;
+  /** Include a QueryExplain with the result */
+  explain?: boolean;
+}
+
+/** How a native query ran. Timings are in milliseconds. */
+export interface QueryExplain {
+  plan: QueryPlan;
+  candidates: number;
+  documentsExamined: number;
+  matched: number;
+  returned: number;
+  workers: number;
+  parallel: boolean;
+  sortStrategy?: string;
+  timings: {
+    index: number;
+    filter: number;
+    sort: number;
+    project: number;
+    total: number;
+  };
+}
+
+export interface QueryResult {
+  documents: any[];
+  total: number;
+  hasMore: boolean;
+  explain?: QueryExplain;
+}
+
+export interface CollectionResult {
+  success?: boolean;
+  count?: number;
+  insertedCount?: number;
+  modifiedCount?: number;
+  removedCount?: number;
+  dropped?: boolean;
+}
+
 export class NativeFilterEngine {
   static async filterDocuments(documents: any[], filter: any, maxResults: number): Promise<any[]> {
     if (!isAvailable) {
@@ -145,8 +451,8 @@ export class NativeFilterEngine {
 
     try {
       const result: FilterResult = await callMethod('filterDocuments', {
-        documents: JSON.stringify(documents),
-        filter: JSON.stringify(filter),
+        documents,
+        filter,
         maxResults,
       });
       if (result.error) {
@@ -158,61 +464,188 @@ export class NativeFilterEngine {
     }
   }
 
-  static async getCandidateIds(filter: any): Promise<string[] | null> {
+  /** Returns null when the sidecar could not be asked. A result with null
+   * ids means the sidecar planned a collection scan. */
+  static async getCandidateIds(
+    scope: IndexScope,
+    filter: any
+  ): Promise<{ ids: string[] | null; plan?: QueryPlan } | null> {
     if (!isAvailable) {
       return null;
     }
 
     try {
       const result: CandidateIdsResult = await callMethod('getCandidateIds', {
-        filter: JSON.stringify(filter),
+        ...scope,
+        filter,
       });
       if (result.error) {
         return null;
       }
-      return result.ids || null;
+      return { ids: result.ids || null, plan: result.plan };
     } catch {
       return null;
     }
   }
 
-  static async rebuildIndexMapping(indexes: Map<string, Map<any, string[]>>): Promise<void> {
+  static async rebuildIndexMapping(
+    scope: IndexScope,
+    indexes: Map<string, Map<any, string[]>>,
+    definitions?: Map<string, { fields: string[]; directions?: Array<1 | -1>; indexName: string }>
+  ): Promise<void> {
     if (!isAvailable) {
       return;
     }
 
     try {
       const indexesObj: Record<string, Record<string, string[]>> = {};
+      const definitionsObj: Record<
+        string,
+        | Array<[string, 1 | -1]>
+        | {
+            fields: Array<[string, 1 | -1]>;
+            unique?: boolean;
+            sparse?: boolean;
+            multikey?: boolean;
+          }
+      > = {};
       for (const [indexName, indexMap] of indexes.entries()) {
         const indexObj: Record<string, string[]> = {};
         for (const [key, ids] of indexMap.entries()) {
-          const keyStr = typeof key === 'string' ? key : JSON.stringify(key);
-          indexObj[keyStr] = ids;
+          // Array and object keys are compared by identity in the Map, so
+          // equal ones land on the same string here.
+          const keyString = indexKeyString(key);
+          const existing = indexObj[keyString];
+          indexObj[keyString] = existing ? existing.concat(ids) : ids;
         }
         indexesObj[indexName] = indexObj;
+
+        const definition = definitions?.get(indexName);
+        if (definition && definition.indexName === indexName) {
+          const fields = definition.fields.map(
+            (field, i): [string, 1 | -1] => [field, definition.directions?.[i] ?? 1]
+          );
+          definitionsObj[indexName] =
+            definition.unique || definition.sparse || definition.multikey
+              ? {
+                  fields,
+                  unique: definition.unique,
+                  sparse: definition.sparse,
+                  multikey: definition.multikey,
+                }
+              : fields;
+        }
       }
       await callMethod('rebuildIndexMapping', {
-        indexes: JSON.stringify(indexesObj),
+        ...scope,
+        indexes: indexesObj,
+        definitions: definitionsObj,
       });
     } catch (error) {
       console.warn('Failed to rebuild index mapping:', error);
     }
   }
 
-  static async sortDocuments(documents: any[], sort: Record<string, 1 | -1>): Promise<any[]> {
+  /** Add one document to the named indexes, keyed the way rebuildIndexMapping keys them.
+   * Rejects with a NativeError with code `DUPLICATE_KEY` if a unique index
+   * already holds another document under the key, or `NO_INDEXES` if the
+   * collection has no indexes. */
+  static async indexInsert(scope: IndexScope, id: string, keys: Record<string, unknown>): Promise<void> {
+    if (!isAvailable) {
+      return;
+    }
+
+    await callMethod('indexInsert', {
+      ...scope,
+      id,
+      keys: indexKeyStrings(keys),
+    });
+  }
+
+  /** Move one document from its old keys to its new keys */
+  static async indexUpdate(
+    scope: IndexScope,
+    id: string,
+    oldKeys: Record<string, unknown>,
+    newKeys: Record<string, unknown>
+  ): Promise<void> {
+    if (!isAvailable) {
+      return;
+    }
+
+    await callMethod('indexUpdate', {
+      ...scope,
+      id,
+      oldKeys: indexKeyStrings(oldKeys),
+      newKeys: indexKeyStrings(newKeys),
+    });
+  }
+
+  /** Remove one document from the named indexes */
+  static async indexDelete(scope: IndexScope, id: string, keys: Record<string, unknown>): Promise<void> {
+    if (!isAvailable) {
+      return;
+    }
+
+    await callMethod('indexDelete', {
+      ...scope,
+      id,
+      keys: indexKeyStrings(keys),
+    });
+  }
+  /** Write the collection's indexes to `<database>/.indexes/<collection>.idx`.
+   * The scope must include the database path. */
+  static async saveIndexSnapshot(scope: IndexScope): Promise<IndexSnapshotResult> {
     if (!isAvailable) {
       throw new Error('Native library not loaded');
     }
 
+    return callMethod('saveIndexSnapshot', { ...scope });
+  }
+
+  /** Load the collection's indexes from its snapshot file. `stale` is true when
+   * the collection's documents changed after the snapshot was written. A stale
+   * snapshot is only loaded with `allowStale`; otherwise the indexes should be
+   * rebuilt. */
+  static async loadIndexSnapshot(
+    scope: IndexScope,
+    options: { allowStale?: boolean } = {}
+  ): Promise<IndexSnapshotResult> {
+    if (!isAvailable) {
+      return { loaded: false };
+    }
+
+    return callMethod('loadIndexSnapshot', { ...scope, ...options });
+  }
+
+  /** Forget every index of a collection */
+  static async dropIndexes(scope: IndexScope): Promise<boolean> {
+    if (!isAvailable) {
+      return false;
+    }
+
     try {
-      const result: SortResult = await callMethod('sortDocuments', {
-        documents: JSON.stringify(documents),
-        sort: JSON.stringify(sort),
-      });
-      if (result.error) {
-        throw new Error(result.error);
-      }
-      return result.results || [];
+      const result: CollectionResult = await callMethod('dropIndexes', { ...scope });
+      return result.dropped === true;
+    } catch {
+      return false;
+    }
+  }
+
+
+  /** Sorts documents. With `limit`, only the page [skip, skip+limit) is
+   * returned, and a small page is selected without sorting everything. */
+  static async sortDocuments(
+    documents: any[],
+    sort: SortSpec,
+    options: SortOptions = {}
+  ): Promise<any[]> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    try {
+      return await sortStream({ documents, sort: sortPairs(sort) }, options);
     } catch (error) {
       throw new Error(`Native sort failed: ${error instanceof Error ? error.message : 'Unknown error'}`);
     }
@@ -225,8 +658,8 @@ export class NativeFilterEngine {
 
     try {
       const result: ProjectResult = await callMethod('projectDocuments', {
-        documents: JSON.stringify(documents),
-        projection: JSON.stringify(projection),
+        documents,
+        projection,
       });
       if (result.error) {
         throw new Error(result.error);
@@ -237,6 +670,141 @@ export class NativeFilterEngine {
     }
   }
 
+  static async loadCollection(collection: CollectionRef, documents: any[]): Promise<number> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    const result: CollectionResult = await callMethod('loadCollection', {
+      ...scopeOf(collection),
+      documents,
+    });
+    return result.count || 0;
+  }
+
+  static async upsertDocuments(collection: CollectionRef, documents: any[]): Promise<number> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    const result: CollectionResult = await callMethod('upsertDocuments', {
+      ...scopeOf(collection),
+      documents,
+    });
+    return result.count || 0;
+  }
+
+  static async removeDocuments(collection: CollectionRef, ids: string[]): Promise<number> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    const result: CollectionResult = await callMethod('removeDocuments', {
+      ...scopeOf(collection),
+      ids,
+    });
+    return result.removedCount || 0;
+  }
+
+  static async dropCollection(collection: CollectionRef): Promise<boolean> {
+    if (!isAvailable) {
+      return false;
+    }
+
+    try {
+      const result: CollectionResult = await callMethod('dropCollection', {
+        ...scopeOf(collection),
+      });
+      return result.dropped === true;
+    } catch {
+      return false;
+    }
+  }
+
+  static async filterCollection(collection: CollectionRef, filter: any, maxResults: number): Promise<any[]> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    try {
+      const result: FilterResult = await callMethod('filterDocuments', {
+        ...scopeOf(collection),
+        filter,
+        maxResults,
+      });
+      return result.results || [];
+    } catch (error) {
+      throw new Error(`Native filter failed: ${error instanceof Error ? error.message : 'Unknown error'}`);
+    }
+  }
+
+  static async sortCollection(
+    collection: CollectionRef,
+    sort: SortSpec,
+    options: SortOptions = {}
+  ): Promise<any[]> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    try {
+      return await sortStream({ ...scopeOf(collection), sort: sortPairs(sort) }, options);
+    } catch (error) {
+      throw new Error(`Native sort failed: ${error instanceof Error ? error.message : 'Unknown error'}`);
+    }
+  }
+
+  /** Runs filter, sort, skip/limit and projection in a single round trip.
+   * @param source Documents to query, or a resident collection */
+  static async query(
+    source: any[] | CollectionRef,
+    filter: any,
+    options: QueryParams = {}
+  ): Promise<QueryResult> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    try {
+      const result: QueryResult = await callMethod('query', {
+        ...(Array.isArray(source) ? { documents: source } : scopeOf(source)),
+        filter,
+        ...options,
+        ...(options.sort ? { sort: sortPairs(options.sort) } : {}),
+      });
+      return {
+        documents: result.documents || [],
+        total: result.total || 0,
+        hasMore: result.hasMore === true,
+        ...(result.explain ? { explain: result.explain } : {}),
+      };
+    } catch (error) {
+      throw new Error(`Native query failed: ${error instanceof Error ? error.message : 'Unknown error'}`);
+    }
+  }
+
+  /** Runs a query and returns only how it ran, not its documents */
+  static async explain(
+    source: any[] | CollectionRef,
+    filter: any,
+    options: QueryParams = {}
+  ): Promise<QueryExplain> {
+    if (!isAvailable) {
+      throw new Error('Native library not loaded');
+    }
+
+    try {
+      return await callMethod('explain', {
+        ...(Array.isArray(source) ? { documents: source } : scopeOf(source)),
+        filter,
+        ...options,
+        ...(options.sort ? { sort: sortPairs(options.sort) } : {}),
+      });
+    } catch (error) {
+      throw new Error(`Native explain failed: ${error instanceof Error ? error.message : 'Unknown error'}`);
+    }
+  }
+
   static isAvailable(): boolean {
     if (binaryPath && existsSync(binaryPath)) {
       return true;
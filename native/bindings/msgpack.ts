@@ -0,0 +1,305 @@
+/** Minimal MessagePack codec for the native sidecar protocol.
+ * Values are encoded the way JSON.stringify would see them: Dates and other
+ * objects with toJSON() go through it, and undefined object members are dropped. */
+
+class Writer {
+  private buffer = Buffer.allocUnsafe(1024);
+  private offset = 0;
+
+  private ensure(size: number) {
+    if (this.offset + size <= this.buffer.length) return;
+    let length = this.buffer.length * 2;
+    while (length < this.offset + size) length *= 2;
+    const next = Buffer.allocUnsafe(length);
+    this.buffer.copy(next, 0, 0, this.offset);
+    this.buffer = next;
+  }
+
+  byte(value: number) {
+    this.ensure(1);
+    this.buffer[this.offset++] = value;
+  }
+
+  uint16(value: number) {
+    this.ensure(2);
+    this.buffer.writeUInt16BE(value, this.offset);
+    this.offset += 2;
+  }
+
+  uint32(value: number) {
+    this.ensure(4);
+    this.buffer.writeUInt32BE(value, this.offset);
+    this.offset += 4;
+  }
+
+  int64(value: number) {
+    this.ensure(8);
+    this.buffer.writeBigInt64BE(BigInt(value), this.offset);
+    this.offset += 8;
+  }
+
+  float64(value: number) {
+    this.ensure(8);
+    this.buffer.writeDoubleBE(value, this.offset);
+    this.offset += 8;
+  }
+
+  string(value: string) {
+    const length = Buffer.byteLength(value);
+    if (length < 32) {
+      this.byte(0xa0 | length);
+    } else if (length <= 0xff) {
+      this.byte(0xd9);
+      this.byte(length);
+    } else if (length <= 0xffff) {
+      this.byte(0xda);
+      this.uint16(length);
+    } else {
+      this.byte(0xdb);
+      this.uint32(length);
+    }
+    this.ensure(length);
+    this.buffer.write(value, this.offset, length, 'utf8');
+    this.offset += length;
+  }
+
+  bytes(value: Uint8Array) {
+    const length = value.length;
+    if (length <= 0xff) {
+      this.byte(0xc4);
+      this.byte(length);
+    } else if (length <= 0xffff) {
+      this.byte(0xc5);
+      this.uint16(length);
+    } else {
+      this.byte(0xc6);
+      this.uint32(length);
+    }
+    this.ensure(length);
+    this.buffer.set(value, this.offset);
+    this.offset += length;
+  }
+
+  result(): Buffer {
+    return this.buffer.subarray(0, this.offset);
+  }
+}
+
+function encodeNumber(writer: Writer, value: number) {
+  if (!Number.isSafeInteger(value) || Object.is(value, -0)) {
+    if (!Number.isFinite(value)) {
+      writer.byte(0xc0);
+      return;
+    }
+    writer.byte(0xcb);
+    writer.float64(value);
+    return;
+  }
+
+  if (value >= 0 && value <= 0x7f) {
+    writer.byte(value);
+  } else if (value < 0 && value >= -32) {
+    writer.byte(value & 0xff);
+  } else if (value >= -0x80000000 && value <= 0x7fffffff) {
+    writer.byte(0xd2);
+    writer.uint32(value >>> 0);
+  } else {
+    writer.byte(0xd3);
+    writer.int64(value);
+  }
+}
+
+function encodeValue(writer: Writer, value: any) {
+  if (value !== null && typeof value === 'object' && typeof value.toJSON === 'function') {
+    value = value.toJSON();
+  }
+
+  if (value === null || value === undefined) {
+    writer.byte(0xc0);
+  } else if (typeof value === 'boolean') {
+    writer.byte(value ? 0xc3 : 0xc2);
+  } else if (typeof value === 'number') {
+    encodeNumber(writer, value);
+  } else if (typeof value === 'string') {
+    writer.string(value);
+  } else if (typeof value === 'bigint') {
+    encodeNumber(writer, Number(value));
+  } else if (value instanceof Uint8Array) {
+    writer.bytes(value);
+  } else if (Array.isArray(value)) {
+    const length = value.length;
+    if (length < 16) {
+      writer.byte(0x90 | length);
+    } else if (length <= 0xffff) {
+      writer.byte(0xdc);
+      writer.uint16(length);
+    } else {
+      writer.byte(0xdd);
+      writer.uint32(length);
+    }
+    for (const item of value) {
+      encodeValue(writer, item === undefined || typeof item === 'function' ? null : item);
+    }
+  } else if (typeof value === 'object') {
+    const keys = Object.keys(value).filter(
+      key => value[key] !== undefined && typeof value[key] !== 'function'
+    );
+    const length = keys.length;
+    if (length < 16) {
+      writer.byte(0x80 | length);
+    } else if (length <= 0xffff) {
+      writer.byte(0xde);
+      writer.uint16(length);
+    } else {
+      writer.byte(0xdf);
+      writer.uint32(length);
+    }
+    for (const key of keys) {
+      writer.string(key);
+      encodeValue(writer, value[key]);
+    }
+  } else {
+    writer.byte(0xc0);
+  }
+}
+
+export function encode(value: unknown): Buffer {
+  const writer = new Writer();
+  encodeValue(writer, value);
+  return writer.result();
+}
+
+class Reader {
+  offset = 0;
+
+  constructor(private readonly buffer: Buffer) {}
+
+  private check(size: number) {
+    if (this.offset + size > this.buffer.length) {
+      throw new Error('msgpack: unexpected end of data');
+    }
+  }
+
+  value(): any {
+    this.check(1);
+    const tag = this.buffer[this.offset++]!;
+
+    if (tag <= 0x7f) return tag;
+    if (tag >= 0xe0) return tag - 0x100;
+    if ((tag & 0xe0) === 0xa0) return this.string(tag & 0x1f);
+    if ((tag & 0xf0) === 0x90) return this.array(tag & 0x0f);
+    if ((tag & 0xf0) === 0x80) return this.map(tag & 0x0f);
+
+    switch (tag) {
+      case 0xc0:
+        return null;
+      case 0xc2:
+        return false;
+      case 0xc3:
+        return true;
+      case 0xca:
+        return this.read(4, o => this.buffer.readFloatBE(o));
+      case 0xcb:
+        return this.read(8, o => this.buffer.readDoubleBE(o));
+      case 0xcc:
+        return this.read(1, o => this.buffer.readUInt8(o));
+      case 0xcd:
+        return this.read(2, o => this.buffer.readUInt16BE(o));
+      case 0xce:
+        return this.read(4, o => this.buffer.readUInt32BE(o));
+      case 0xcf:
+        return this.read(8, o => Number(this.buffer.readBigUInt64BE(o)));
+      case 0xd0:
+        return this.read(1, o => this.buffer.readInt8(o));
+      case 0xd1:
+        return this.read(2, o => this.buffer.readInt16BE(o));
+      case 0xd2:
+        return this.read(4, o => this.buffer.readInt32BE(o));
+      case 0xd3:
+        return this.read(8, o => Number(this.buffer.readBigInt64BE(o)));
+      case 0xd9:
+        return this.string(this.read(1, o => this.buffer.readUInt8(o)));
+      case 0xda:
+        return this.string(this.read(2, o => this.buffer.readUInt16BE(o)));
+      case 0xdb:
+        return this.string(this.read(4, o => this.buffer.readUInt32BE(o)));
+      case 0xc4:
+        return this.bytes(this.read(1, o => this.buffer.readUInt8(o)));
+      case 0xc5:
+        return this.bytes(this.read(2, o => this.buffer.readUInt16BE(o)));
+      case 0xc6:
+        return this.bytes(this.read(4, o => this.buffer.readUInt32BE(o)));
+      case 0xdc:
+        return this.array(this.read(2, o => this.buffer.readUInt16BE(o)));
+      case 0xdd:
+        return this.array(this.read(4, o => this.buffer.readUInt32BE(o)));
+      case 0xde:
+        return this.map(this.read(2, o => this.buffer.readUInt16BE(o)));
+      case 0xdf:
+        return this.map(this.read(4, o => this.buffer.readUInt32BE(o)));
+    }
+
+    throw new Error(
+      `msgpack: unsupported type 0x${tag.toString(16)} at offset ${this.offset - 1}`
+    );
+  }
+
+  private read<T>(size: number, fn: (offset: number) => T): T {
+    this.check(size);
+    const value = fn(this.offset);
+    this.offset += size;
+    return value;
+  }
+
+  private string(length: number): string {
+    this.check(length);
+    const value = this.buffer.toString('utf8', this.offset, this.offset + length);
+    this.offset += length;
+    return value;
+  }
+
+  private bytes(length: number): Buffer {
+    this.check(length);
+    const value = Buffer.from(this.buffer.subarray(this.offset, this.offset + length));
+    this.offset += length;
+    return value;
+  }
+
+  private array(length: number): any[] {
+    const value = new Array(length);
+    for (let i = 0; i < length; i++) {
+      value[i] = this.value();
+    }
+    return value;
+  }
+
+  private map(length: number): Record<string, any> {
+    const value: Record<string, any> = {};
+    for (let i = 0; i < length; i++) {
+      const key = String(this.value());
+      const item = this.value();
+      if (key === '__proto__') {
+        Object.defineProperty(value, key, {
+          value: item,
+          enumerable: true,
+          writable: true,
+          configurable: true,
+        });
+      } else {
+        value[key] = item;
+      }
+    }
+    return value;
+  }
+}
+
+export function decode(buffer: Buffer): any {
+  const reader = new Reader(buffer);
+  const value = reader.value();
+  if (reader.offset !== buffer.length) {
+    throw new Error(
+      `msgpack: ${buffer.length - reader.offset} trailing bytes`
+    );
+  }
+  return value;
+}
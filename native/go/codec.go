@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+)
+
+type codec interface {
+	Name() string
+	DecodeRequest(data []byte) (Request, error)
+	EncodeResponse(resp Response) ([]byte, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return encodingJSON }
+
+// DecodeRequest hands a sort object with several fields on as JSON text.
+// Decoded into a map it would have lost its field order; parseSort reads the
+// text in the order the fields were written.
+func (jsonCodec) DecodeRequest(data []byte) (Request, error) {
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return req, err
+	}
+	if spec, ok := req.Params["sort"].(map[string]interface{}); ok && len(spec) > 1 {
+		var raw struct {
+			Params struct {
+				Sort json.RawMessage `json:"sort"`
+			} `json:"params"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return req, err
+		}
+		req.Params["sort"] = string(raw.Params.Sort)
+	}
+	return req, nil
+}
+
+func (jsonCodec) EncodeResponse(resp Response) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return encodingMsgpack }
+
+func (msgpackCodec) DecodeRequest(data []byte) (Request, error) {
+	var req Request
+
+	v, err := msgpackUnmarshal(data)
+	if err != nil {
+		return req, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return req, fmt.Errorf("msgpack: request must be a map, got %T", v)
+	}
+
+	req.ID = obj["id"]
+	req.Method, _ = obj["method"].(string)
+	if params, ok := obj["params"].(map[string]interface{}); ok {
+		req.Params = params
+	}
+	return req, nil
+}
+
+func (msgpackCodec) EncodeResponse(resp Response) ([]byte, error) {
+	obj := map[string]interface{}{"result": resp.Result}
+	if resp.ID != nil {
+		obj["id"] = resp.ID
+	}
+	if resp.Error != "" {
+		obj["error"] = resp.Error
+	}
+	if resp.ErrorCode != "" {
+		obj["code"] = resp.ErrorCode
+		obj["details"] = resp.Details
+	}
+	if resp.Partial {
+		obj["partial"] = true
+	}
+	return msgpackMarshal(obj)
+}
+
+func codecByName(name string) (codec, error) {
+	switch name {
+	case encodingJSON:
+		return jsonCodec{}, nil
+	case encodingMsgpack:
+		return msgpackCodec{}, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", name)
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const maxCompiledFilterCacheSize = 500
+
+var (
+	compiledFilterCache   = make(map[string]predicate, 64)
+	compiledFilterCacheMu sync.RWMutex
+)
+
+// A predicate is a compiled filter. Predicates are immutable once built, so a
+// cached one is shared freely between requests and filter workers.
+type predicate interface {
+	Match(document map[string]interface{}) bool
+}
+
+// A valueMatcher is a compiled field condition applied to the value found at
+// the field's path.
+type valueMatcher interface {
+	MatchValue(value interface{}) bool
+}
+
+type matchAllPredicate struct{}
+
+func (matchAllPredicate) Match(map[string]interface{}) bool { return true }
+
+type andPredicate []predicate
+
+func (p andPredicate) Match(document map[string]interface{}) bool {
+	for _, child := range p {
+		if !child.Match(document) {
+			return false
+		}
+	}
+	return true
+}
+
+type orPredicate []predicate
+
+func (p orPredicate) Match(document map[string]interface{}) bool {
+	for _, child := range p {
+		if child.Match(document) {
+			return true
+		}
+	}
+	return false
+}
+
+type norPredicate []predicate
+
+func (p norPredicate) Match(document map[string]interface{}) bool {
+	for _, child := range p {
+		if child.Match(document) {
+			return false
+		}
+	}
+	return true
+}
+
+type fieldPredicate struct {
+	path     string
+	segments []string
+	matcher  valueMatcher
+}
+
+func (p *fieldPredicate) Match(document map[string]interface{}) bool {
+	var value interface{}
+	if len(p.segments) == 1 {
+		value = document[p.path]
+	} else {
+		value, _ = lookupSegments(document, p.segments)
+	}
+	return p.matcher.MatchValue(value)
+}
+
+type textPredicate struct {
+	search *TextSearch
+}
+
+func (p *textPredicate) Match(document map[string]interface{}) bool {
+	return p.search.Matches(document)
+}
+
+type allOfMatcher []valueMatcher
+
+func (m allOfMatcher) MatchValue(value interface{}) bool {
+	for _, matcher := range m {
+		if !matcher.MatchValue(value) {
+			return false
+		}
+	}
+	return true
+}
+
+type neverMatcher struct{}
+
+func (neverMatcher) MatchValue(interface{}) bool { return false }
+
+// equalMatcher holds an equality test specialised for the expected value, so
+// scalar comparisons skip reflection and JSON encoding.
+type equalMatcher struct {
+	equals func(value interface{}) bool
+	negate bool
+}
+
+func newEqualMatcher(expected interface{}, negate bool) *equalMatcher {
+	var equals func(value interface{}) bool
+
+	switch want := expected.(type) {
+	case nil:
+		equals = func(value interface{}) bool { return value == nil }
+	case string:
+		equals = func(value interface{}) bool {
+			got, ok := value.(string)
+			return ok && got == want
+		}
+	case bool:
+		equals = func(value interface{}) bool {
+			got, ok := value.(bool)
+			return ok && got == want
+		}
+	case float64:
+		equals = func(value interface{}) bool {
+			got, ok := value.(float64)
+			return ok && got == want
+		}
+	default:
+		wantType := reflect.TypeOf(expected)
+		wantJSON, err := json.Marshal(expected)
+		equals = func(value interface{}) bool {
+			if err != nil || value == nil || reflect.TypeOf(value) != wantType {
+				return false
+			}
+			got, gotErr := json.Marshal(value)
+			return gotErr == nil && string(got) == string(wantJSON)
+		}
+	}
+
+	return &equalMatcher{equals: equals, negate: negate}
+}
+
+func (m *equalMatcher) matches(value interface{}) bool {
+	if m.equals(value) {
+		return true
+	}
+	if arr, ok := value.([]interface{}); ok {
+		for _, element := range arr {
+			if m.equals(element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *equalMatcher) MatchValue(value interface{}) bool {
+	return anyPathValue(value, m.matches) != m.negate
+}
+
+// rangeMatcher only matches values of the same type as its bound, so $gt: 5
+// never matches a string and $lt: "m" never matches a number.
+type rangeMatcher struct {
+	op    string
+	bound interface{}
+}
+
+func (m *rangeMatcher) match(value interface{}) bool {
+	cmp, ok := compareInClass(value, m.bound)
+	if !ok {
+		return false
+	}
+	switch m.op {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+// MatchValue tests each element of an array value, and the array as a whole
+// when the bound is itself an array.
+func (m *rangeMatcher) MatchValue(value interface{}) bool {
+	if _, ok := value.(pathValues); ok {
+		return anyPathValue(value, m.MatchValue)
+	}
+	if matchesAny(value, m.match) {
+		return true
+	}
+	_, boundIsArray := m.bound.([]interface{})
+	_, valueIsArray := value.([]interface{})
+	return boundIsArray && valueIsArray && m.match(value)
+}
+
+type inMatcher struct {
+	set    map[string]bool
+	negate bool
+}
+
+func (m *inMatcher) contains(value interface{}) bool {
+	if m.set[valueKey(value)] {
+		return true
+	}
+	if arr, ok := value.([]interface{}); ok {
+		for _, element := range arr {
+			if m.set[valueKey(element)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *inMatcher) MatchValue(value interface{}) bool {
+	return anyPathValue(value, m.contains) != m.negate
+}
+
+type existsMatcher struct {
+	exists bool
+}
+
+func (m *existsMatcher) MatchValue(value interface{}) bool {
+	return (value != nil) == m.exists
+}
+
+type regexMatcher struct {
+	regex *regexp.Regexp
+}
+
+func (m *regexMatcher) MatchValue(value interface{}) bool {
+	return matchesAny(value, func(v interface{}) bool {
+		str, ok := v.(string)
+		return ok && m.regex.MatchString(str)
+	})
+}
+
+type sizeMatcher struct {
+	size float64
+}
+
+func (m *sizeMatcher) MatchValue(value interface{}) bool {
+	if _, ok := value.(pathValues); ok {
+		return anyPathValue(value, m.MatchValue)
+	}
+	arr, ok := value.([]interface{})
+	return ok && float64(len(arr)) == m.size
+}
+
+type elemMatchMatcher struct {
+	operators valueMatcher
+	document  predicate
+}
+
+func (m *elemMatchMatcher) MatchValue(value interface{}) bool {
+	if _, ok := value.(pathValues); ok {
+		return anyPathValue(value, m.MatchValue)
+	}
+	arr, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, element := range arr {
+		if m.operators != nil {
+			if m.operators.MatchValue(element) {
+				return true
+			}
+			continue
+		}
+		if elementMap, ok := element.(map[string]interface{}); ok && m.document.Match(elementMap) {
+			return true
+		}
+	}
+	return false
+}
+
+type notMatcher struct {
+	inner valueMatcher
+}
+
+func (m *notMatcher) MatchValue(value interface{}) bool {
+	return !m.inner.MatchValue(value)
+}
+
+type typeMatcher struct {
+	names []string
+}
+
+func (m *typeMatcher) MatchValue(value interface{}) bool {
+	if _, ok := value.(pathValues); ok {
+		return anyPathValue(value, m.MatchValue)
+	}
+	for _, name := range m.names {
+		if hasType(value, name) {
+			return true
+		}
+		if _, isArray := value.([]interface{}); isArray && name != "array" {
+			if matchesAny(value, func(v interface{}) bool { return hasType(v, name) }) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type modMatcher struct {
+	divisor   float64
+	remainder float64
+}
+
+func (m *modMatcher) MatchValue(value interface{}) bool {
+	return matchesAny(value, func(v interface{}) bool {
+		num, ok := toNumber(v)
+		return ok && math.Mod(math.Trunc(num), m.divisor) == m.remainder
+	})
+}
+
+type textMatcher struct {
+	search *TextSearch
+}
+
+func (m *textMatcher) MatchValue(value interface{}) bool {
+	return m.search.Matches(value)
+}
+
+// getCompiledFilter compiles a filter, reusing an earlier compilation of the
+// same filter text when there is one.
+func getCompiledFilter(filter map[string]interface{}) (predicate, error) {
+	if len(filter) == 0 {
+		return matchAllPredicate{}, nil
+	}
+
+	keyBytes, err := json.Marshal(filter)
+	if err != nil {
+		return compileFilter(filter)
+	}
+	key := string(keyBytes)
+
+	compiledFilterCacheMu.RLock()
+	compiled, ok := compiledFilterCache[key]
+	compiledFilterCacheMu.RUnlock()
+	if ok {
+		return compiled, nil
+	}
+
+	compiled, err = compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledFilterCacheMu.Lock()
+	if len(compiledFilterCache) >= maxCompiledFilterCacheSize {
+		for k := range compiledFilterCache {
+			delete(compiledFilterCache, k)
+			break
+		}
+	}
+	compiledFilterCache[key] = compiled
+	compiledFilterCacheMu.Unlock()
+	return compiled, nil
+}
+
+// compileFilter turns a filter document into a predicate tree, rejecting
+// operators the engine does not understand instead of letting them silently
+// match every document.
+func compileFilter(filter map[string]interface{}) (predicate, error) {
+	predicates := make(andPredicate, 0, len(filter))
+
+	for field, value := range filter {
+		if len(field) > 0 && field[0] == '$' {
+			compiled, err := compileTopLevel(field, value)
+			if err != nil {
+				return nil, err
+			}
+			predicates = append(predicates, compiled)
+			continue
+		}
+
+		var matcher valueMatcher
+		if operators, ok := isOperatorObject(value); ok {
+			var err error
+			if matcher, err = compileOperators(field, operators); err != nil {
+				return nil, err
+			}
+		} else {
+			matcher = newEqualMatcher(value, false)
+		}
+
+		predicates = append(predicates, &fieldPredicate{
+			path:     field,
+			segments: splitPath(field),
+			matcher:  matcher,
+		})
+	}
+
+	if len(predicates) == 1 {
+		return predicates[0], nil
+	}
+	return predicates, nil
+}
+
+func compileTopLevel(operator string, value interface{}) (predicate, error) {
+	switch operator {
+	case "$and", "$or", "$nor":
+		conditions, ok := value.([]interface{})
+		if !ok || len(conditions) == 0 {
+			return nil, fmt.Errorf("%s requires a non-empty array", operator)
+		}
+		branches := make([]predicate, 0, len(conditions))
+		for _, condition := range conditions {
+			condMap, ok := condition.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s entries must be objects", operator)
+			}
+			branch, err := compileFilter(condMap)
+			if err != nil {
+				return nil, err
+			}
+			branches = append(branches, branch)
+		}
+		switch operator {
+		case "$and":
+			return andPredicate(branches), nil
+		case "$or":
+			return orPredicate(branches), nil
+		default:
+			return norPredicate(branches), nil
+		}
+	case "$text":
+		search, err := parseTextSearch(value)
+		if err != nil {
+			return nil, err
+		}
+		return &textPredicate{search: search}, nil
+	}
+	return nil, fmt.Errorf("unknown top-level operator: %s", operator)
+}
+
+func compileOperators(field string, operators map[string]interface{}) (valueMatcher, error) {
+	matchers := make(allOfMatcher, 0, len(operators))
+
+	for op, opValue := range operators {
+		var matcher valueMatcher
+
+		switch op {
+		case "$eq":
+			matcher = newEqualMatcher(opValue, false)
+		case "$ne":
+			matcher = newEqualMatcher(opValue, true)
+		case "$gt", "$gte", "$lt", "$lte":
+			matcher = &rangeMatcher{op: op, bound: opValue}
+		case "$in", "$nin":
+			candidates, ok := opValue.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s on field %s requires an array", op, field)
+			}
+			set := make(map[string]bool, len(candidates))
+			for _, candidate := range candidates {
+				set[valueKey(candidate)] = true
+			}
+			matcher = &inMatcher{set: set, negate: op == "$nin"}
+		case "$exists":
+			// Numbers count as flags the way MongoDB reads them: 0 is false
+			// and anything else true.
+			exists, ok := opValue.(bool)
+			if number, isNumber := toNumber(opValue); isNumber {
+				exists, ok = number != 0, true
+			}
+			if !ok {
+				return nil, fmt.Errorf("$exists on field %s requires a boolean or a number", field)
+			}
+			matcher = &existsMatcher{exists: exists}
+		case "$regex":
+			pattern, ok := opValue.(string)
+			if !ok {
+				return nil, fmt.Errorf("$regex on field %s requires a string", field)
+			}
+			options, _ := operators["$options"].(string)
+			regex := getCachedRegex(regexPattern(pattern, options))
+			if regex == nil {
+				return nil, fmt.Errorf("invalid $regex on field %s: %s", field, pattern)
+			}
+			matcher = &regexMatcher{regex: regex}
+		case "$options":
+			options, ok := opValue.(string)
+			if !ok {
+				return nil, fmt.Errorf("$options on field %s requires a string", field)
+			}
+			if _, hasRegex := operators["$regex"]; !hasRegex {
+				return nil, fmt.Errorf("$options on field %s requires $regex", field)
+			}
+			for _, option := range options {
+				if !strings.ContainsRune("imsx", option) {
+					return nil, fmt.Errorf("unsupported $options flag %q on field %s", option, field)
+				}
+			}
+			continue
+		case "$all":
+			required, ok := opValue.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$all on field %s requires an array", field)
+			}
+			if len(required) == 0 {
+				matcher = neverMatcher{}
+				break
+			}
+			all := make(allOfMatcher, 0, len(required))
+			for _, item := range required {
+				if condition, ok := item.(map[string]interface{}); ok {
+					if elemMatch, ok := condition["$elemMatch"].(map[string]interface{}); ok {
+						compiled, err := compileElemMatch(field, elemMatch)
+						if err != nil {
+							return nil, err
+						}
+						all = append(all, compiled)
+						continue
+					}
+				}
+				all = append(all, newEqualMatcher(item, false))
+			}
+			matcher = all
+		case "$size":
+			size, ok := toNumber(opValue)
+			if !ok {
+				return nil, fmt.Errorf("$size on field %s requires a number", field)
+			}
+			matcher = &sizeMatcher{size: size}
+		case "$elemMatch":
+			condition, ok := opValue.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$elemMatch on field %s requires an object", field)
+			}
+			compiled, err := compileElemMatch(field, condition)
+			if err != nil {
+				return nil, err
+			}
+			matcher = compiled
+		case "$not":
+			if pattern, ok := opValue.(string); ok {
+				regex := getCachedRegex(pattern)
+				if regex == nil {
+					return nil, fmt.Errorf("invalid $not pattern on field %s: %s", field, pattern)
+				}
+				matcher = &notMatcher{inner: &regexMatcher{regex: regex}}
+				break
+			}
+			nested, ok := isOperatorObject(opValue)
+			if !ok {
+				return nil, fmt.Errorf("$not on field %s requires an operator object", field)
+			}
+			inner, err := compileOperators(field, nested)
+			if err != nil {
+				return nil, err
+			}
+			matcher = &notMatcher{inner: inner}
+		case "$type":
+			aliases, ok := opValue.([]interface{})
+			if !ok {
+				aliases = []interface{}{opValue}
+			}
+			names := make([]string, 0, len(aliases))
+			for _, alias := range aliases {
+				name, ok := typeName(alias)
+				if !ok {
+					return nil, fmt.Errorf("unknown $type %v on field %s", alias, field)
+				}
+				names = append(names, name)
+			}
+			matcher = &typeMatcher{names: names}
+		case "$mod":
+			divisor, remainder, err := parseMod(opValue)
+			if err != nil {
+				return nil, fmt.Errorf("%v on field %s", err, field)
+			}
+			matcher = &modMatcher{divisor: divisor, remainder: remainder}
+		case "$text":
+			search, err := parseTextSearch(opValue)
+			if err != nil {
+				return nil, fmt.Errorf("%v on field %s", err, field)
+			}
+			matcher = &textMatcher{search: search}
+		default:
+			return nil, fmt.Errorf("unknown operator %s on field %s", op, field)
+		}
+
+		matchers = append(matchers, matcher)
+	}
+
+	if len(matchers) == 1 {
+		return matchers[0], nil
+	}
+	return matchers, nil
+}
+
+func compileElemMatch(field string, condition map[string]interface{}) (valueMatcher, error) {
+	if operators, ok := isOperatorObject(condition); ok {
+		compiled, err := compileOperators(field, operators)
+		if err != nil {
+			return nil, err
+		}
+		return &elemMatchMatcher{operators: compiled}, nil
+	}
+
+	compiled, err := compileFilter(condition)
+	if err != nil {
+		return nil, err
+	}
+	return &elemMatchMatcher{document: compiled}, nil
+}
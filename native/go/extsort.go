@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// At most this many runs are merged at once, which bounds the open files.
+// More runs are first merged in groups, in order, into longer ones.
+const maxMergeWidth = 64
+
+// externalSort sorts documents that may not fit in a memory budget. The
+// input is cut into runs that each fit the budget; a run is sorted and
+// written to a temporary file, and the runs are then merged back in one
+// ordered stream that is sent in parts of at most half the budget.
+//
+// The budget is compared against an estimate of the decoded documents'
+// size, not a measurement, so it is a target rather than a hard cap. It
+// bounds the runs and the parts sent back, not the sort's memory: the input
+// is already decoded in full when the sort starts, and a resident
+// collection keeps its documents whatever the sort does with them.
+type externalSort struct {
+	documents  []map[string]interface{}
+	sortFields []SortField
+	skip       int
+	limit      int
+	budget     int
+	tempDir    string
+}
+
+func newExternalSort(documents []map[string]interface{}, sortFields []SortField, skip, limit, budget int, tempDir string) *externalSort {
+	return &externalSort{
+		documents:  documents,
+		sortFields: sortFields,
+		skip:       max(skip, 0),
+		limit:      limit,
+		budget:     budget,
+		tempDir:    tempDir,
+	}
+}
+
+// inMemory reports whether the sort can skip spilling: without sort fields
+// there is nothing to order, and a top-K sort only keeps skip+limit
+// documents.
+func (s *externalSort) inMemory() bool {
+	return len(s.sortFields) == 0 || (s.limit > 0 && (s.skip+s.limit)*topKMaxFraction <= len(s.documents))
+}
+
+func (s *externalSort) stream(emit func(part interface{})) (interface{}, error) {
+	if s.inMemory() {
+		return s.sortInMemory()
+	}
+	less := documentLess(s.sortFields)
+
+	var dir string
+	defer func() {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	var runs []string
+	start, size := 0, 0
+	for i, doc := range s.documents {
+		size += documentSize(doc)
+		if size <= s.budget && i < len(s.documents)-1 {
+			continue
+		}
+		// Everything fit: no run was cut before the last document.
+		if size <= s.budget && len(runs) == 0 {
+			break
+		}
+
+		if dir == "" {
+			var err error
+			if dir, err = os.MkdirTemp(s.tempDir, "nubodb-sort-*"); err != nil {
+				return nil, err
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("run-%d", len(runs)))
+		if err := writeRun(path, s.documents[start:i+1], less); err != nil {
+			return nil, err
+		}
+		runs = append(runs, path)
+
+		// The run is on disk; drop the references to it. Documents sent
+		// with the request can then be collected, while a resident
+		// collection still holds its own.
+		for j := start; j <= i; j++ {
+			s.documents[j] = nil
+		}
+		start, size = i+1, 0
+	}
+	if len(runs) == 0 {
+		return s.sortInMemory()
+	}
+
+	for pass := 0; len(runs) > maxMergeWidth; pass++ {
+		merged := make([]string, 0, (len(runs)+maxMergeWidth-1)/maxMergeWidth)
+		for i := 0; i < len(runs); i += maxMergeWidth {
+			group := runs[i:min(i+maxMergeWidth, len(runs))]
+			path := filepath.Join(dir, fmt.Sprintf("merge-%d-%d", pass, len(merged)))
+			if err := mergeRunsToFile(path, group, less); err != nil {
+				return nil, err
+			}
+			merged = append(merged, path)
+		}
+		runs = merged
+	}
+
+	partBudget := max(s.budget/2, 1)
+	part := make([]map[string]interface{}, 0)
+	partSize, position := 0, 0
+	err := mergeRuns(runs, less, func(doc map[string]interface{}) (bool, error) {
+		position++
+		if position <= s.skip {
+			return true, nil
+		}
+		part = append(part, doc)
+		partSize += documentSize(doc)
+		if partSize >= partBudget {
+			emit(map[string]interface{}{"results": part})
+			part = make([]map[string]interface{}, 0)
+			partSize = 0
+		}
+		return s.limit <= 0 || position < s.skip+s.limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"results":  part,
+		"strategy": sortStrategyExternal,
+		"runs":     len(runs),
+	}, nil
+}
+
+func (s *externalSort) sortInMemory() (interface{}, error) {
+	results, strategy := sortWindow(s.documents, s.sortFields, s.skip, s.limit)
+	return map[string]interface{}{"results": results, "strategy": strategy}, nil
+}
+
+// documentSize estimates how much memory a decoded value holds. It only has
+// to be close enough to decide when a run has outgrown the budget.
+func documentSize(v interface{}) int {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		size := 48
+		for key, item := range val {
+			size += len(key) + 16 + documentSize(item)
+		}
+		return size
+	case []interface{}:
+		size := 24
+		for _, item := range val {
+			size += documentSize(item)
+		}
+		return size
+	case string:
+		return len(val) + 16
+	default:
+		return 16
+	}
+}
+
+// writeRun sorts documents and writes them to path, one JSON document per
+// line.
+func writeRun(path string, documents []map[string]interface{}, less func(a, b map[string]interface{}) bool) error {
+	sortWithLess(documents, less)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, doc := range documents {
+		if err := writeRunDocument(w, doc); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func writeRunDocument(w *bufio.Writer, doc map[string]interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	return w.WriteByte('\n')
+}
+
+func mergeRunsToFile(path string, runs []string, less func(a, b map[string]interface{}) bool) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = mergeRuns(runs, less, func(doc map[string]interface{}) (bool, error) {
+		return true, writeRunDocument(w, doc)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	for _, run := range runs {
+		os.Remove(run)
+	}
+	return err
+}
+
+// runReader reads the documents of one run file in order.
+type runReader struct {
+	file  *os.File
+	r     *bufio.Reader
+	order int
+	head  map[string]interface{}
+}
+
+func openRun(path string, order int) (*runReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runReader{file: file, r: bufio.NewReader(file), order: order}, nil
+}
+
+// next reads the run's next document into head, and reports false at the
+// end of the run.
+func (r *runReader) next() (bool, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	r.head = nil
+	if err := json.Unmarshal(line, &r.head); err != nil {
+		return false, fmt.Errorf("%s: %w", r.file.Name(), err)
+	}
+	return true, nil
+}
+
+// runHeap orders runs by their head document. Runs with equal heads keep
+// the order they were cut in, so a tie between runs goes to the document
+// that came first in the input.
+type runHeap struct {
+	runs []*runReader
+	less func(a, b map[string]interface{}) bool
+}
+
+func (h *runHeap) Len() int {
+	return len(h.runs)
+}
+
+func (h *runHeap) Less(i, j int) bool {
+	a, b := h.runs[i], h.runs[j]
+	if h.less(a.head, b.head) {
+		return true
+	}
+	if h.less(b.head, a.head) {
+		return false
+	}
+	return a.order < b.order
+}
+
+func (h *runHeap) Swap(i, j int) {
+	h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+}
+
+func (h *runHeap) Push(x interface{}) {
+	h.runs = append(h.runs, x.(*runReader))
+}
+
+func (h *runHeap) Pop() interface{} {
+	last := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return last
+}
+
+// mergeRuns merges the sorted run files into one ordered stream, passing
+// each document to yield until yield returns false.
+func mergeRuns(paths []string, less func(a, b map[string]interface{}) bool, yield func(doc map[string]interface{}) (bool, error)) error {
+	h := &runHeap{runs: make([]*runReader, 0, len(paths)), less: less}
+	defer func() {
+		for _, run := range h.runs {
+			run.file.Close()
+		}
+	}()
+
+	for i, path := range paths {
+		run, err := openRun(path, i)
+		if err != nil {
+			return err
+		}
+		ok, err := run.next()
+		if err != nil || !ok {
+			run.file.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		h.runs = append(h.runs, run)
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		run := h.runs[0]
+		more, err := yield(run.head)
+		if err != nil || !more {
+			return err
+		}
+
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			run.file.Close()
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
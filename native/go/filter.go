@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -19,27 +23,6 @@ var (
 	regexMutex sync.RWMutex
 )
 
-type FilterEntry struct {
-	Field string
-	Value interface{}
-}
-
-func parseFilter(filterJSON string) ([]FilterEntry, error) {
-	var filterMap map[string]interface{}
-	if err := json.Unmarshal([]byte(filterJSON), &filterMap); err != nil {
-		return nil, err
-	}
-
-	entries := make([]FilterEntry, 0, len(filterMap))
-	for field, value := range filterMap {
-		entries = append(entries, FilterEntry{
-			Field: field,
-			Value: value,
-		})
-	}
-	return entries, nil
-}
-
 func getCachedRegex(pattern string) *regexp.Regexp {
 	regexMutex.RLock()
 	if regex, exists := regexCache[pattern]; exists {
@@ -70,254 +53,325 @@ func getCachedRegex(pattern string) *regexp.Regexp {
 	return regex
 }
 
-func matchesComparisonOperators(value interface{}, operators map[string]interface{}) bool {
-	for op, opValue := range operators {
-		switch op {
-		case "$eq":
-			if !deepEqual(value, opValue) {
-				return false
-			}
-		case "$ne":
-			if deepEqual(value, opValue) {
-				return false
-			}
-		case "$gt":
-			if numVal, ok := toNumber(value); ok {
-				if numOp, ok := toNumber(opValue); ok {
-					if numVal <= numOp {
-						return false
-					}
-				}
-			}
-		case "$gte":
-			if numVal, ok := toNumber(value); ok {
-				if numOp, ok := toNumber(opValue); ok {
-					if numVal < numOp {
-						return false
-					}
-				}
-			}
-		case "$lt":
-			if numVal, ok := toNumber(value); ok {
-				if numOp, ok := toNumber(opValue); ok {
-					if numVal >= numOp {
-						return false
-					}
-				}
-			}
-		case "$lte":
-			if numVal, ok := toNumber(value); ok {
-				if numOp, ok := toNumber(opValue); ok {
-					if numVal > numOp {
-						return false
-					}
-				}
-			}
-		case "$in":
-			if arr, ok := opValue.([]interface{}); ok {
-				inSet := make(map[interface{}]bool, len(arr))
-				for _, v := range arr {
-					inSet[v] = true
-				}
-				if !inSet[value] {
-					return false
-				}
-			}
-		case "$nin":
-			if arr, ok := opValue.([]interface{}); ok {
-				ninSet := make(map[interface{}]bool, len(arr))
-				for _, v := range arr {
-					ninSet[v] = true
-				}
-				if ninSet[value] {
-					return false
-				}
-			}
-		case "$exists":
-			if exists, ok := opValue.(bool); ok {
-				if exists && value == nil {
-					return false
-				}
-				if !exists && value != nil {
-					return false
-				}
-			}
-		case "$regex":
-			if strVal, ok := value.(string); ok {
-				if pattern, ok := opValue.(string); ok {
-					regex := getCachedRegex(pattern)
-					if regex == nil || !regex.MatchString(strVal) {
-						return false
-					}
-				}
-			} else {
-				return false
-			}
+func isOperatorObject(value interface{}) (map[string]interface{}, bool) {
+	valueMap, ok := value.(map[string]interface{})
+	if !ok || len(valueMap) == 0 {
+		return nil, false
+	}
+	for key := range valueMap {
+		if len(key) == 0 || key[0] != '$' {
+			return nil, false
 		}
 	}
-	return true
+	return valueMap, true
 }
 
-func matchesLogicalOperator(document map[string]interface{}, operator string, conditions []interface{}) bool {
-	switch operator {
-	case "$and":
-		for _, condition := range conditions {
-			if condMap, ok := condition.(map[string]interface{}); ok {
-				entries := make([]FilterEntry, 0, len(condMap))
-				for field, value := range condMap {
-					entries = append(entries, FilterEntry{Field: field, Value: value})
-				}
-				if !matchesFilter(document, entries) {
-					return false
-				}
-			}
-		}
-		return true
-	case "$or":
-		for _, condition := range conditions {
-			if condMap, ok := condition.(map[string]interface{}); ok {
-				entries := make([]FilterEntry, 0, len(condMap))
-				for field, value := range condMap {
-					entries = append(entries, FilterEntry{Field: field, Value: value})
-				}
-				if matchesFilter(document, entries) {
-					return true
-				}
+// matchesAny applies a scalar condition the way MongoDB does: an array field
+// matches when any of its elements does.
+func matchesAny(value interface{}, match func(interface{}) bool) bool {
+	if values, ok := value.(pathValues); ok {
+		return anyPathValue(values, func(v interface{}) bool { return matchesAny(v, match) })
+	}
+	if arr, ok := value.([]interface{}); ok {
+		for _, element := range arr {
+			if match(element) {
+				return true
 			}
 		}
 		return false
-	case "$nor":
-		for _, condition := range conditions {
-			if condMap, ok := condition.(map[string]interface{}); ok {
-				entries := make([]FilterEntry, 0, len(condMap))
-				for field, value := range condMap {
-					entries = append(entries, FilterEntry{Field: field, Value: value})
-				}
-				if matchesFilter(document, entries) {
-					return false
-				}
-			}
+	}
+	return match(value)
+}
+
+// anyPathValue applies match to each value of a path that went through an
+// array of embedded documents, or to value itself for any other path.
+func anyPathValue(value interface{}, match func(interface{}) bool) bool {
+	values, ok := value.(pathValues)
+	if !ok {
+		return match(value)
+	}
+	for _, v := range values {
+		if match(v) {
+			return true
 		}
-		return true
 	}
-	return true
+	return false
 }
 
-func matchesFilter(document map[string]interface{}, entries []FilterEntry) bool {
-	for _, entry := range entries {
-		if len(entry.Field) > 0 && entry.Field[0] == '$' {
-			if conditions, ok := entry.Value.([]interface{}); ok {
-				if !matchesLogicalOperator(document, entry.Field, conditions) {
-					return false
-				}
+func valueKey(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "z"
+	case string:
+		return "s" + val
+	case bool:
+		if val {
+			return "bt"
+		}
+		return "bf"
+	}
+	if num, ok := toNumber(v); ok {
+		return "n" + strconv.FormatFloat(num, 'g', -1, 64)
+	}
+	data, _ := json.Marshal(v)
+	return "j" + string(data)
+}
+
+var typeAliases = map[float64]string{
+	1:  "double",
+	2:  "string",
+	3:  "object",
+	4:  "array",
+	8:  "bool",
+	9:  "date",
+	10: "null",
+	16: "int",
+	18: "long",
+	19: "decimal",
+}
+
+func typeName(alias interface{}) (string, bool) {
+	if name, ok := alias.(string); ok {
+		switch name {
+		case "double", "string", "object", "array", "bool", "date", "null", "int", "long", "decimal", "number":
+			return name, true
+		}
+		return "", false
+	}
+	if code, ok := toNumber(alias); ok {
+		name, exists := typeAliases[code]
+		return name, exists
+	}
+	return "", false
+}
+
+func hasType(value interface{}, name string) bool {
+	switch name {
+	case "null":
+		return value == nil
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "bool":
+		_, ok := value.(bool)
+		return ok
+	case "date":
+		_, ok := parseTime(value)
+		return ok
+	case "number", "double", "decimal":
+		_, ok := toNumber(value)
+		return ok
+	case "int", "long":
+		num, ok := toNumber(value)
+		return ok && num == math.Trunc(num)
+	}
+	return false
+}
+
+func parseMod(value interface{}) (float64, float64, error) {
+	arr, ok := value.([]interface{})
+	if !ok || len(arr) != 2 {
+		return 0, 0, fmt.Errorf("$mod requires an array of [divisor, remainder]")
+	}
+	divisor, okDivisor := toNumber(arr[0])
+	remainder, okRemainder := toNumber(arr[1])
+	if !okDivisor || !okRemainder {
+		return 0, 0, fmt.Errorf("$mod divisor and remainder must be numbers")
+	}
+	divisor, remainder = math.Trunc(divisor), math.Trunc(remainder)
+	if divisor == 0 {
+		return 0, 0, fmt.Errorf("$mod divisor cannot be 0")
+	}
+	return divisor, remainder, nil
+}
+
+// regexPattern folds $options into the pattern as inline flags. Go's regexp
+// has no extended mode, so "x" is applied by stripping whitespace and
+// comments from the pattern.
+func regexPattern(pattern string, options string) string {
+	if options == "" {
+		return pattern
+	}
+
+	flags := make([]byte, 0, 3)
+	for _, option := range []byte(options) {
+		switch option {
+		case 'i', 'm', 's':
+			flags = append(flags, option)
+		case 'x':
+			pattern = stripExtendedPattern(pattern)
+		}
+	}
+	if len(flags) == 0 {
+		return pattern
+	}
+	return "(?" + string(flags) + ")" + pattern
+}
+
+func stripExtendedPattern(pattern string) string {
+	var out strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			out.WriteByte(c)
+			out.WriteByte(pattern[i+1])
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
 			}
-		} else {
-			fieldValue := document[entry.Field]
-			if valueMap, ok := entry.Value.(map[string]interface{}); ok {
-				if !matchesComparisonOperators(fieldValue, valueMap) {
-					return false
-				}
-			} else {
-				if !deepEqual(fieldValue, entry.Value) {
-					return false
-				}
+			out.WriteByte(c)
+		case c == '[':
+			inClass = true
+			out.WriteByte(c)
+		case c == '#':
+			for i < len(pattern) && pattern[i] != '\n' {
+				i++
 			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+		default:
+			out.WriteByte(c)
 		}
 	}
-	return true
+	return out.String()
 }
 
-func FilterDocuments(documentsJSON string, filterJSON string, maxResults int) string {
-	var documents []map[string]interface{}
-	if err := json.Unmarshal([]byte(documentsJSON), &documents); err != nil {
-		return `{"error":"` + err.Error() + `"}`
-	}
+// filterStats records how a filter pass ran, for explain output.
+type filterStats struct {
+	Examined int
+	Workers  int
+	Parallel bool
+}
 
-	entries, err := parseFilter(filterJSON)
+func filterDocumentsWithStats(documents []map[string]interface{}, filter map[string]interface{}, maxResults int) ([]map[string]interface{}, filterStats, error) {
+	stats := filterStats{Workers: 1}
+	pred, err := getCompiledFilter(filter)
 	if err != nil {
-		return `{"error":"` + err.Error() + `"}`
+		return nil, stats, err
 	}
 
 	if maxResults == 0 || len(documents) == 0 {
-		return `{"results":[]}`
+		return []map[string]interface{}{}, stats, nil
 	}
 
-	if len(entries) == 0 {
+	if len(filter) == 0 {
 		if maxResults < len(documents) {
 			documents = documents[:maxResults]
 		}
-		result, _ := json.Marshal(map[string]interface{}{"results": documents})
-		return string(result)
+		return documents, stats, nil
 	}
 
 	docCount := len(documents)
-	if docCount <= batchSize {
-		results := make([]map[string]interface{}, 0, min(maxResults, docCount))
-		for i := 0; i < docCount && len(results) < maxResults; i++ {
-			if matchesFilter(documents[i], entries) {
-				results = append(results, documents[i])
-			}
-		}
-		resultJSON, _ := json.Marshal(map[string]interface{}{"results": results})
-		return string(resultJSON)
+	if docCount <= batchSize || runtime.NumCPU() == 1 {
+		results, examined := filterSerial(documents, pred, maxResults)
+		stats.Examined = examined
+		return results, stats, nil
 	}
 
+	numChunks := (docCount + batchSize - 1) / batchSize
 	numWorkers := runtime.NumCPU() * numWorkersFactor
-	if numWorkers > docCount {
-		numWorkers = docCount
+	if numWorkers > numChunks {
+		numWorkers = numChunks
 	}
 	if numWorkers < 1 {
 		numWorkers = 1
 	}
+	stats.Workers = numWorkers
+	stats.Parallel = true
 
-	type docResult struct {
-		doc   map[string]interface{}
-		index int
+	results, examined := filterParallel(documents, pred, maxResults, numWorkers)
+	stats.Examined = examined
+	return results, stats, nil
+}
+
+// filterSerial returns the first maxResults matches in a single loop, and
+// the number of documents it examined.
+func filterSerial(documents []map[string]interface{}, pred predicate, maxResults int) ([]map[string]interface{}, int) {
+	results := make([]map[string]interface{}, 0, min(maxResults, len(documents)))
+	examined := 0
+	for i := 0; i < len(documents) && len(results) < maxResults; i++ {
+		examined++
+		if pred.Match(documents[i]) {
+			results = append(results, documents[i])
+		}
 	}
+	return results, examined
+}
 
-	docCh := make(chan docResult, batchSize*2)
-	results := make([]map[string]interface{}, 0, maxResults)
-	resultMu := sync.Mutex{}
-	resultCount := int32(0)
-	var wg sync.WaitGroup
+// filterParallel returns the same matches as filterSerial using numWorkers
+// goroutines. Documents are split into contiguous chunks that workers claim
+// in order. Each chunk keeps its own matches, so concatenating the chunks
+// gives the matches in document order no matter which worker finished first.
+func filterParallel(documents []map[string]interface{}, pred predicate, maxResults, numWorkers int) ([]map[string]interface{}, int) {
+	docCount := len(documents)
+	numChunks := (docCount + batchSize - 1) / batchSize
+
+	chunkResults := make([][]map[string]interface{}, numChunks)
+	chunkDone := make([]bool, numChunks)
+	var progressMu sync.Mutex
+	frontier := 0
+	matchedBeforeFrontier := 0
+
+	var nextChunk int64 = -1
+	var examined int64
 	var done int32
+	var wg sync.WaitGroup
 
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for res := range docCh {
-				if atomic.LoadInt32(&done) == 1 {
-					continue
+			for atomic.LoadInt32(&done) == 0 {
+				chunk := int(atomic.AddInt64(&nextChunk, 1))
+				if chunk >= numChunks {
+					return
 				}
 
-				if matchesFilter(res.doc, entries) {
-					resultMu.Lock()
-					if resultCount < int32(maxResults) {
-						results = append(results, res.doc)
-						resultCount++
-						if resultCount >= int32(maxResults) {
-							atomic.StoreInt32(&done, 1)
-						}
+				start := chunk * batchSize
+				end := min(start+batchSize, docCount)
+				var matches []map[string]interface{}
+				j := start
+				for ; j < end && len(matches) < maxResults; j++ {
+					if pred.Match(documents[j]) {
+						matches = append(matches, documents[j])
 					}
-					resultMu.Unlock()
 				}
+				chunkResults[chunk] = matches
+				atomic.AddInt64(&examined, int64(j-start))
+
+				// Once every chunk up to the frontier is finished and together they
+				// hold maxResults matches, later chunks cannot change the answer.
+				progressMu.Lock()
+				chunkDone[chunk] = true
+				for frontier < numChunks && chunkDone[frontier] {
+					matchedBeforeFrontier += len(chunkResults[frontier])
+					frontier++
+				}
+				if matchedBeforeFrontier >= maxResults {
+					atomic.StoreInt32(&done, 1)
+				}
+				progressMu.Unlock()
 			}
 		}()
 	}
 
-	go func() {
-		for i, doc := range documents {
-			if atomic.LoadInt32(&done) == 1 {
-				break
-			}
-			docCh <- docResult{doc: doc, index: i}
-		}
-		close(docCh)
-	}()
-
 	wg.Wait()
 
-	resultJSON, _ := json.Marshal(map[string]interface{}{"results": results})
-	return string(resultJSON)
-}
\ No newline at end of file
+	results := make([]map[string]interface{}, 0, min(maxResults, matchedBeforeFrontier))
+	for chunk := 0; chunk < frontier && len(results) < maxResults; chunk++ {
+		matches := chunkResults[chunk]
+		if remaining := maxResults - len(results); len(matches) > remaining {
+			matches = matches[:remaining]
+		}
+		results = append(results, matches...)
+	}
+	return results, int(examined)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func filterTestDocuments(n int) []map[string]interface{} {
+	documents := make([]map[string]interface{}, n)
+	for i := range documents {
+		documents[i] = map[string]interface{}{
+			"_id":    fmt.Sprintf("doc-%06d", i),
+			"n":      float64(i),
+			"status": []string{"active", "archived", "pending"}[i%3],
+			"email":  fmt.Sprintf("user%d@example.com", i),
+			"tags":   []interface{}{"t" + fmt.Sprint(i%7), "t" + fmt.Sprint(i%11)},
+		}
+	}
+	return documents
+}
+
+func documentIDs(documents []map[string]interface{}) []string {
+	ids := make([]string, len(documents))
+	for i, doc := range documents {
+		ids[i], _ = documentID(doc)
+	}
+	return ids
+}
+
+func equalIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFilterMaxResultsReturnsFirstMatchesInOrder(t *testing.T) {
+	documents := filterTestDocuments(20000)
+	filter := map[string]interface{}{"status": "archived"}
+
+	var want []string
+	for i := 1; len(want) < 250; i += 3 {
+		want = append(want, fmt.Sprintf("doc-%06d", i))
+	}
+
+	for run := 0; run < 20; run++ {
+		results, stats, err := filterDocumentsWithStats(documents, filter, len(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runtime.NumCPU() > 1 && !stats.Parallel {
+			t.Fatalf("run %d: expected the parallel path for %d documents", run, len(documents))
+		}
+		if got := documentIDs(results); !equalIDs(got, want) {
+			t.Fatalf("run %d: got %d ids starting %v, want the first %d matches", run, len(got), got[:min(len(got), 3)], len(want))
+		}
+	}
+}
+
+// The parallel path is compared with the serial one directly, so the test
+// covers it even on a single CPU, where filterDocumentsWithStats never
+// takes it.
+func TestFilterParallelMatchesSerial(t *testing.T) {
+	documents := filterTestDocuments(5000)
+	pred, err := getCompiledFilter(map[string]interface{}{
+		"n":    map[string]interface{}{"$gte": float64(1000)},
+		"tags": "t3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, maxResults := range []int{1, 7, 100, 101, len(documents)} {
+		want, _ := filterSerial(documents, pred, maxResults)
+		for _, workers := range []int{1, 2, 8, 32} {
+			got, _ := filterParallel(documents, pred, maxResults, workers)
+			if !equalIDs(documentIDs(got), documentIDs(want)) {
+				t.Errorf("maxResults %d, %d workers: got %d matches, want %d in document order", maxResults, workers, len(got), len(want))
+			}
+		}
+	}
+}
+
+func BenchmarkFilterDocuments(b *testing.B) {
+	documents := filterTestDocuments(100000)
+	pred, err := getCompiledFilter(map[string]interface{}{
+		"email": map[string]interface{}{"$regex": "9@example", "$options": "i"},
+		"n":     map[string]interface{}{"$gte": float64(10)},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	workers := runtime.NumCPU() * numWorkersFactor
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filterSerial(documents, pred, len(documents))
+		}
+	})
+	b.Run(fmt.Sprintf("parallel-%d", workers), func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filterParallel(documents, pred, len(documents), workers)
+		}
+	})
+}
+
+func TestExistsOperand(t *testing.T) {
+	documents := []map[string]interface{}{
+		{"_id": "with", "a": float64(1)},
+		{"_id": "without"},
+	}
+	tests := []struct {
+		operand interface{}
+		want    []string
+	}{
+		{true, []string{"with"}},
+		{false, []string{"without"}},
+		{float64(1), []string{"with"}},
+		{float64(-2.5), []string{"with"}},
+		{float64(0), []string{"without"}},
+	}
+	for _, tt := range tests {
+		filter := map[string]interface{}{"a": map[string]interface{}{"$exists": tt.operand}}
+		results, _, err := filterDocumentsWithStats(documents, filter, len(documents))
+		if err != nil {
+			t.Fatalf("$exists: %v: %v", tt.operand, err)
+		}
+		if got := documentIDs(results); !equalIDs(got, tt.want) {
+			t.Errorf("$exists: %v matched %v, want %v", tt.operand, got, tt.want)
+		}
+	}
+
+	for _, operand := range []interface{}{"yes", nil, []interface{}{}} {
+		filter := map[string]interface{}{"a": map[string]interface{}{"$exists": operand}}
+		if _, _, err := filterDocumentsWithStats(documents, filter, len(documents)); err == nil {
+			t.Errorf("$exists: %#v was accepted", operand)
+		}
+	}
+}
+
+// A path through an array of embedded documents reaches one value per
+// element, and each value that is an array is matched like a top-level one.
+func TestArrayFieldsThroughSubdocuments(t *testing.T) {
+	documents := []map[string]interface{}{
+		{"_id": "one", "items": []interface{}{
+			map[string]interface{}{"tags": []interface{}{"x", "y"}},
+		}},
+		{"_id": "split", "items": []interface{}{
+			map[string]interface{}{"tags": []interface{}{"x"}},
+			map[string]interface{}{"tags": []interface{}{"y", "z"}},
+		}},
+		{"_id": "scalar", "items": []interface{}{
+			map[string]interface{}{"tags": "x"},
+			map[string]interface{}{"sku": "a"},
+		}},
+		{"_id": "other", "items": []interface{}{
+			map[string]interface{}{"tags": []interface{}{"w"}},
+		}},
+	}
+	tests := []struct {
+		condition interface{}
+		want      []string
+	}{
+		{"x", []string{"one", "split", "scalar"}},
+		{[]interface{}{"x", "y"}, []string{"one"}},
+		{map[string]interface{}{"$ne": "x"}, []string{"other"}},
+		{map[string]interface{}{"$in": []interface{}{"y"}}, []string{"one", "split"}},
+		{map[string]interface{}{"$nin": []interface{}{"x", "z"}}, []string{"other"}},
+		{map[string]interface{}{"$all": []interface{}{"x", "y"}}, []string{"one", "split"}},
+		{map[string]interface{}{"$size": float64(2)}, []string{"one", "split"}},
+		{map[string]interface{}{"$size": float64(1)}, []string{"split", "other"}},
+		{map[string]interface{}{"$size": float64(3)}, []string{}},
+		{map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": "z"}}, []string{"split"}},
+		{map[string]interface{}{"$regex": "^[yz]$"}, []string{"one", "split"}},
+		{map[string]interface{}{"$not": map[string]interface{}{"$size": float64(1)}}, []string{"one", "scalar"}},
+	}
+	for _, tt := range tests {
+		filter := map[string]interface{}{"items.tags": tt.condition}
+		results, _, err := filterDocumentsWithStats(documents, filter, len(documents))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.condition, err)
+		}
+		if got := documentIDs(results); !equalIDs(got, tt.want) {
+			t.Errorf("%v matched %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+
+	if got := getPathValue(documents[1], "items.tags"); len(got.([]interface{})) != 2 {
+		t.Errorf("items.tags read as %v, want one value per element", got)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type methodHandler func(params map[string]interface{}) (interface{}, error)
+
+var methods = map[string]methodHandler{
+	"filterDocuments":     handleFilterDocuments,
+	"getCandidateIds":     handleGetCandidateIds,
+	"rebuildIndexMapping": handleRebuildIndexMapping,
+	"indexInsert":         handleIndexInsert,
+	"indexUpdate":         handleIndexUpdate,
+	"indexDelete":         handleIndexDelete,
+	"dropIndexes":         handleDropIndexes,
+	"saveIndexSnapshot":   handleSaveIndexSnapshot,
+	"loadIndexSnapshot":   handleLoadIndexSnapshot,
+	"sortDocuments":       handleSortDocuments,
+	"projectDocuments":    handleProjectDocuments,
+	"loadCollection":      handleLoadCollection,
+	"upsertDocuments":     handleUpsertDocuments,
+	"removeDocuments":     handleRemoveDocuments,
+	"dropCollection":      handleDropCollection,
+	"query":               handleQuery,
+	"explain":             handleExplain,
+}
+
+func handleFilterDocuments(params map[string]interface{}) (interface{}, error) {
+	documents, err := documentsSource(params)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := objectParam(params, "filter")
+	if err != nil {
+		return nil, err
+	}
+	maxResults := intParam(params, "maxResults", 0)
+
+	start := time.Now()
+	results, stats, err := filterDocumentsWithStats(documents, filter, maxResults)
+	if err != nil {
+		return nil, err
+	}
+	if !boolParam(params, "explain") {
+		return map[string]interface{}{"results": results}, nil
+	}
+
+	elapsed := millisSince(start)
+	return map[string]interface{}{
+		"results": results,
+		"explain": QueryExplain{
+			Plan:              scanPlan(),
+			Candidates:        len(documents),
+			DocumentsExamined: stats.Examined,
+			Matched:           len(results),
+			Returned:          len(results),
+			Workers:           stats.Workers,
+			Parallel:          stats.Parallel,
+			Timings:           PhaseTimings{Filter: elapsed, Total: elapsed},
+		},
+	}, nil
+}
+
+func handleGetCandidateIds(params map[string]interface{}) (interface{}, error) {
+	database, collection, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := objectParam(params, "filter")
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	plan := scanPlan()
+	if resolver := getResolver(database, collection); resolver != nil {
+		ids, plan = resolver.getCandidateIds(filter)
+	}
+	return map[string]interface{}{"ids": ids, "plan": plan}, nil
+}
+
+func handleRebuildIndexMapping(params map[string]interface{}) (interface{}, error) {
+	database, collection, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := indexesParam(params, "indexes")
+	if err != nil {
+		return nil, err
+	}
+
+	definitions, err := indexDefinitionsParam(params, "definitions")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := getOrCreateResolver(database, collection).rebuildIndexMapping(indexes, definitions); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true}, nil
+}
+
+func handleIndexInsert(params map[string]interface{}) (interface{}, error) {
+	resolver, err := indexResolverParam(params)
+	if err != nil {
+		return nil, err
+	}
+	id, err := stringParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := indexKeysParam(params, "keys")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolver.indexInsert(id, keys); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true}, nil
+}
+
+func handleIndexUpdate(params map[string]interface{}) (interface{}, error) {
+	resolver, err := indexResolverParam(params)
+	if err != nil {
+		return nil, err
+	}
+	id, err := stringParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	oldKeys, err := indexKeysParam(params, "oldKeys")
+	if err != nil {
+		return nil, err
+	}
+	newKeys, err := indexKeysParam(params, "newKeys")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolver.indexUpdate(id, oldKeys, newKeys); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true}, nil
+}
+
+func handleIndexDelete(params map[string]interface{}) (interface{}, error) {
+	resolver, err := indexResolverParam(params)
+	if err != nil {
+		return nil, err
+	}
+	id, err := stringParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := indexKeysParam(params, "keys")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolver.indexDelete(id, keys); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true}, nil
+}
+
+func handleDropIndexes(params map[string]interface{}) (interface{}, error) {
+	database, collection, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"dropped": dropResolver(database, collection)}, nil
+}
+
+func handleSaveIndexSnapshot(params map[string]interface{}) (interface{}, error) {
+	database, collection, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	if database == "" {
+		return nil, fmt.Errorf("missing parameter: database")
+	}
+	resolver, err := indexResolverParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return saveIndexSnapshot(database, collection, resolver)
+}
+
+func handleLoadIndexSnapshot(params map[string]interface{}) (interface{}, error) {
+	database, collection, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	if database == "" {
+		return nil, fmt.Errorf("missing parameter: database")
+	}
+
+	return loadIndexSnapshot(database, collection, boolParam(params, "allowStale"))
+}
+
+func handleSortDocuments(params map[string]interface{}) (interface{}, error) {
+	documents, err := documentsSource(params)
+	if err != nil {
+		return nil, err
+	}
+	sortFields, err := sortParam(params, "sort")
+	if err != nil {
+		return nil, err
+	}
+	skip := intParam(params, "skip", 0)
+	limit := intParam(params, "limit", 0)
+
+	if budget := intParam(params, "memoryBudget", 0); budget > 0 {
+		tempDir, _ := params["tempDir"].(string)
+		// The sort drops documents as it spills them, which only frees
+		// them once the request no longer holds the decoded input too.
+		// The whole input is still decoded first; see externalSort.
+		delete(params, "documents")
+		return newExternalSort(documents, sortFields, skip, limit, budget, tempDir), nil
+	}
+
+	results, strategy := sortWindow(documents, sortFields, skip, limit)
+	return map[string]interface{}{"results": results, "strategy": strategy}, nil
+}
+
+func handleProjectDocuments(params map[string]interface{}) (interface{}, error) {
+	documents, err := documentsSource(params)
+	if err != nil {
+		return nil, err
+	}
+	projection, err := objectParam(params, "projection")
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"results": projectDocuments(documents, projection)}, nil
+}
+
+func handleLoadCollection(params map[string]interface{}) (interface{}, error) {
+	database, name, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := documentsParam(params, "documents")
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := loadCollection(database, name, documents)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true, "count": count}, nil
+}
+
+func handleUpsertDocuments(params map[string]interface{}) (interface{}, error) {
+	database, name, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := documentsParam(params, "documents")
+	if err != nil {
+		return nil, err
+	}
+
+	store := getOrCreateCollection(database, name)
+	inserted, modified, err := store.Upsert(documents)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"insertedCount": inserted,
+		"modifiedCount": modified,
+		"count":         store.Len(),
+	}, nil
+}
+
+func handleRemoveDocuments(params map[string]interface{}) (interface{}, error) {
+	database, name, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := stringsParam(params, "ids")
+	if err != nil {
+		return nil, err
+	}
+
+	store := getCollection(database, name)
+	if store == nil {
+		return map[string]interface{}{"removedCount": 0, "count": 0}, nil
+	}
+	removed := store.Remove(ids)
+	return map[string]interface{}{"removedCount": removed, "count": store.Len()}, nil
+}
+
+func handleDropCollection(params map[string]interface{}) (interface{}, error) {
+	database, name, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"dropped": dropCollection(database, name)}, nil
+}
+
+func handleQuery(params map[string]interface{}) (interface{}, error) {
+	var spec QuerySpec
+	var err error
+
+	if spec.Filter, err = optionalObjectParam(params, "filter"); err != nil {
+		return nil, err
+	}
+	if spec.Sort, err = optionalSortParam(params, "sort"); err != nil {
+		return nil, err
+	}
+	if spec.Projection, err = optionalObjectParam(params, "projection"); err != nil {
+		return nil, err
+	}
+	spec.Skip = intParam(params, "skip", 0)
+	spec.Limit = intParam(params, "limit", 0)
+	spec.Explain = boolParam(params, "explain")
+
+	start := time.Now()
+	documents, plan, err := queryCandidates(params, spec.Filter)
+	if err != nil {
+		return nil, err
+	}
+	indexTime := millisSince(start)
+
+	result, err := runQuery(documents, spec)
+	if err != nil {
+		return nil, err
+	}
+	if result.Explain != nil {
+		result.Explain.Plan = plan
+		result.Explain.Timings.Index = indexTime
+		result.Explain.Timings.Total = millisSince(start)
+	}
+	return result, nil
+}
+
+// handleExplain runs a query for its explain output alone.
+func handleExplain(params map[string]interface{}) (interface{}, error) {
+	queryParams := make(map[string]interface{}, len(params)+1)
+	for name, value := range params {
+		queryParams[name] = value
+	}
+	queryParams["explain"] = true
+
+	result, err := handleQuery(queryParams)
+	if err != nil {
+		return nil, err
+	}
+	return result.(QueryResult).Explain, nil
+}
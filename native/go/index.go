@@ -2,22 +2,89 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-type IndexEntry struct {
-	Key   interface{}
-	Value []string
+// IndexField is one field of an index definition. Direction is 1 for
+// ascending and -1 for descending.
+type IndexField struct {
+	Field     string
+	Direction int
+}
+
+// IndexDefinition describes an index's fields in key order. A unique index
+// holds at most one document per key. A sparse index leaves out documents
+// whose key is missing or null. A multikey index holds array values under
+// each of their elements; an index becomes multikey on its own once it is
+// given a key that holds an array.
+type IndexDefinition struct {
+	Fields   []IndexField
+	Unique   bool
+	Sparse   bool
+	Multikey bool
 }
 
 type IndexMetadata struct {
-	Name         string
-	Fields       []string
-	IndexMap     map[string][]string
-	SortedEntries []IndexEntry
-	mutex        sync.RWMutex
+	Name       string
+	Fields     []string
+	Directions []int
+	Unique     bool
+	Sparse     bool
+	Multikey   bool
+	IndexMap   map[string][]string
+	Sorted     *skipList
+	Postings   int
+	mutex      sync.RWMutex
+}
+
+// DuplicateKeyError reports a write that would put a second document under a
+// key of a unique index.
+type DuplicateKeyError struct {
+	Index         string
+	Key           string
+	ID            string
+	ConflictingID string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key in unique index %s: %s is already held by %s", e.Index, e.Key, e.ConflictingID)
+}
+
+func (e *DuplicateKeyError) ErrorCode() string {
+	return "DUPLICATE_KEY"
+}
+
+func (e *DuplicateKeyError) ErrorDetails() interface{} {
+	return map[string]interface{}{
+		"index":         e.Index,
+		"key":           decodeIndexKey(e.Key),
+		"id":            e.ID,
+		"conflictingId": e.ConflictingID,
+	}
+}
+
+// NoIndexesError reports an index method called for a collection that has
+// no indexes. A client keeping indexes in step with its writes can take it
+// to mean there is nothing to update.
+type NoIndexesError struct {
+	Collection string
+}
+
+func (e *NoIndexesError) Error() string {
+	return fmt.Sprintf("no indexes loaded for collection: %s", e.Collection)
+}
+
+func (e *NoIndexesError) ErrorCode() string {
+	return "NO_INDEXES"
+}
+
+func (e *NoIndexesError) ErrorDetails() interface{} {
+	return map[string]interface{}{"collection": e.Collection}
 }
 
 type IndexResolver struct {
@@ -26,81 +93,287 @@ type IndexResolver struct {
 	mutex         sync.RWMutex
 }
 
-var resolver *IndexResolver
-var resolverOnce sync.Once
+// Each collection has its own resolver, keyed by the database path as well as
+// the collection name, so indexes of same-named fields never collide.
+var (
+	resolvers   = make(map[string]*IndexResolver)
+	resolversMu sync.RWMutex
+)
 
-func getResolver() *IndexResolver {
-	resolverOnce.Do(func() {
-		resolver = &IndexResolver{
-			IndexMetadata: make(map[string]*IndexMetadata),
-			FieldToIndex:  make(map[string][]string),
-		}
-	})
+// collectionKey identifies a collection within the process. It keys both the
+// resolvers and the resident document stores.
+func collectionKey(database, collection string) string {
+	return database + "\x00" + collection
+}
+
+func newIndexResolver() *IndexResolver {
+	return &IndexResolver{
+		IndexMetadata: make(map[string]*IndexMetadata),
+		FieldToIndex:  make(map[string][]string),
+	}
+}
+
+func getResolver(database, collection string) *IndexResolver {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+	return resolvers[collectionKey(database, collection)]
+}
+
+func getOrCreateResolver(database, collection string) *IndexResolver {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+
+	key := collectionKey(database, collection)
+	resolver := resolvers[key]
+	if resolver == nil {
+		resolver = newIndexResolver()
+		resolvers[key] = resolver
+	}
 	return resolver
 }
 
-func extractFieldsFromIndexName(indexName string) []string {
-	name := strings.TrimSuffix(indexName, "_index")
-	return strings.FieldsFunc(name, func(c rune) bool {
-		return c == '_'
-	})
+func dropResolver(database, collection string) bool {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+
+	key := collectionKey(database, collection)
+	_, exists := resolvers[key]
+	delete(resolvers, key)
+	return exists
 }
 
-func RebuildIndexMapping(indexesJSON string) {
-	var indexes map[string]map[string][]string
-	if err := json.Unmarshal([]byte(indexesJSON), &indexes); err != nil {
-		return
+// rebuildIndexMapping replaces every index. definitions gives each index's
+// fields in key order; an index without one is taken to be a single-field
+// index on the field it is named after, which is how schema indexes are named.
+// Compound index keys are arrays holding one value per field. If any index
+// cannot be built, such as a unique index with a duplicate key, nothing is
+// replaced.
+func (resolver *IndexResolver) rebuildIndexMapping(indexes map[string]map[string][]string, definitions map[string]IndexDefinition) error {
+	built := make(map[string]*IndexMetadata, len(indexes))
+	for _, indexName := range sortedKeys(indexes) {
+		metadata := newIndexMetadata(indexName, definitions[indexName])
+		if err := metadata.load(indexes[indexName]); err != nil {
+			return err
+		}
+		built[indexName] = metadata
 	}
 
-	resolver := getResolver()
+	resolver.replaceIndexes(built)
+	return nil
+}
+
+// replaceIndexes swaps in a complete set of built indexes.
+func (resolver *IndexResolver) replaceIndexes(built map[string]*IndexMetadata) {
 	resolver.mutex.Lock()
 	defer resolver.mutex.Unlock()
 
-	resolver.FieldToIndex = make(map[string][]string, len(indexes)*2)
-	resolver.IndexMetadata = make(map[string]*IndexMetadata, len(indexes))
+	resolver.FieldToIndex = make(map[string][]string, len(built))
+	resolver.IndexMetadata = built
 
-	for indexName, indexMap := range indexes {
-		fields := extractFieldsFromIndexName(indexName)
+	for _, indexName := range sortedKeys(built) {
+		// Only the leading field can drive a lookup; later fields of a compound
+		// index are reached through its prefix.
+		leading := built[indexName].Fields[0]
+		resolver.FieldToIndex[leading] = append(resolver.FieldToIndex[leading], indexName)
+	}
+}
+
+func newIndexMetadata(name string, definition IndexDefinition) *IndexMetadata {
+	if len(definition.Fields) == 0 {
+		definition.Fields = []IndexField{{Field: strings.TrimSuffix(name, "_index"), Direction: 1}}
+	}
+
+	fields := make([]string, len(definition.Fields))
+	directions := make([]int, len(definition.Fields))
+	for i, field := range definition.Fields {
+		fields[i] = field.Field
+		directions[i] = field.Direction
+	}
+
+	compare := compareValues
+	if len(fields) > 1 {
+		compare = tupleComparator(directions)
+	}
+
+	return &IndexMetadata{
+		Name:       name,
+		Fields:     fields,
+		Directions: directions,
+		Unique:     definition.Unique,
+		Sparse:     definition.Sparse,
+		Multikey:   definition.Multikey,
+		IndexMap:   make(map[string][]string),
+		Sorted:     newSkipList(compare),
+	}
+}
+
+// load fills a new index from its key mapping. Array keys of a single-field
+// index are split into their elements and null keys of a sparse index are
+// dropped.
+func (index *IndexMetadata) load(indexMap map[string][]string) error {
+	entries := make(map[string][]string, len(indexMap))
+	for raw, ids := range indexMap {
+		key, err := parseIndexKey(raw)
+		if err != nil {
+			return fmt.Errorf("index %s: %w", index.Name, err)
+		}
+		for _, elementKey := range index.documentKeys(key) {
+			entries[elementKey] = append(entries[elementKey], ids...)
+		}
+	}
+	return index.fill(entries)
+}
+
+// fill sets a new index's postings to entries, which are already keyed the
+// way the index stores them. A unique index may not have two documents under
+// a key.
+func (index *IndexMetadata) fill(entries map[string][]string) error {
+	for _, key := range sortedKeys(entries) {
+		ids := entries[key]
+		if index.Unique && len(ids) > 1 {
+			return &DuplicateKeyError{Index: index.Name, Key: key, ID: ids[1], ConflictingID: ids[0]}
+		}
+		index.IndexMap[key] = ids
+		index.Sorted.Set(key, ids)
+		index.Postings += len(ids)
+	}
+	return nil
+}
 
-		metadata := &IndexMetadata{
-			Name:     indexName,
-			Fields:   fields,
-			IndexMap: make(map[string][]string, len(indexMap)),
+// documentKeys returns the keys a document with the given key is indexed
+// under, and marks the index as multikey if key holds an array. An array
+// value is indexed under each of its distinct elements, so a condition on
+// one element can find it. An empty array keeps its own key so the document
+// stays in the index. Keys a sparse index leaves out are dropped. The caller
+// holds the write lock.
+func (index *IndexMetadata) documentKeys(key string) []string {
+	keys := index.elementKeys(key)
+	if len(keys) != 1 || keys[0] != key {
+		index.Multikey = true
+	}
+
+	kept := keys[:0]
+	for _, key := range keys {
+		if !index.skipsKey(key) {
+			kept = append(kept, key)
 		}
+	}
+	return kept
+}
+
+// elementKeys returns the keys a document with the given key is indexed
+// under, before a sparse index drops any. An array in a single-field index
+// stands for each of its distinct elements. A compound key whose fields hold
+// arrays is expanded into one tuple per combination of their elements, so
+// {a: [1, 3], b: 2} is found by {a: 1, b: 2} as well as {a: 3, b: 2}.
+func (index *IndexMetadata) elementKeys(key string) []string {
+	var expanded []interface{}
+	if len(index.Fields) == 1 {
+		expanded = arrayElements(decodeIndexKey(key))
+	} else if tuple, ok := decodeIndexKey(key).([]interface{}); ok {
+		expanded = tupleCombinations(tuple)
+	}
+	if expanded == nil {
+		return []string{key}
+	}
 
-		for key, ids := range indexMap {
-			metadata.IndexMap[key] = ids
+	keys := make([]string, 0, len(expanded))
+	seen := make(map[string]bool, len(expanded))
+	for _, element := range expanded {
+		elementKey := indexKey(element)
+		if !seen[elementKey] {
+			keys = append(keys, elementKey)
+			seen[elementKey] = true
 		}
+	}
+	return keys
+}
 
-		resolver.IndexMetadata[indexName] = metadata
+// arrayElements returns the elements of a non-empty array, and nil for any
+// other value. An empty array is indexed as it is.
+func arrayElements(value interface{}) []interface{} {
+	if elements, ok := value.([]interface{}); ok && len(elements) > 0 {
+		return elements
+	}
+	return nil
+}
 
-		for _, field := range fields {
-			if resolver.FieldToIndex[field] == nil {
-				resolver.FieldToIndex[field] = make([]string, 0, 1)
+// tupleCombinations returns every tuple formed by taking one element of each
+// array field of a compound key, or nil when no field holds an array.
+func tupleCombinations(tuple []interface{}) []interface{} {
+	combinations := [][]interface{}{{}}
+	hasArray := false
+	for _, value := range tuple {
+		elements := arrayElements(value)
+		if elements == nil {
+			elements = []interface{}{value}
+		} else {
+			hasArray = true
+		}
+
+		next := make([][]interface{}, 0, len(combinations)*len(elements))
+		for _, prefix := range combinations {
+			for _, element := range elements {
+				combination := make([]interface{}, len(prefix), len(tuple))
+				copy(combination, prefix)
+				next = append(next, append(combination, element))
 			}
-			resolver.FieldToIndex[field] = append(resolver.FieldToIndex[field], indexName)
 		}
+		combinations = next
+	}
+	if !hasArray {
+		return nil
 	}
+
+	expanded := make([]interface{}, len(combinations))
+	for i, combination := range combinations {
+		expanded[i] = combination
+	}
+	return expanded
 }
 
-func findIndexesForField(field string) []string {
-	resolver := getResolver()
-	resolver.mutex.RLock()
-	defer resolver.mutex.RUnlock()
-	return resolver.FieldToIndex[field]
+// isNullKey reports whether key is a missing or null value, which for a
+// compound index means every field is missing or null. The string "null" is
+// an ordinary key.
+func isNullKey(key string) bool {
+	for _, value := range indexTuple(decodeIndexKey(key)) {
+		if value != nil {
+			return false
+		}
+	}
+	return true
 }
 
+// The getFieldIds functions return nil when the index cannot answer a
+// condition and a non-nil, possibly empty, slice when it can.
+
 func getFieldIdsFromValue(index *IndexMetadata, value interface{}) []string {
+	// A null condition also matches documents without the field, which the
+	// index keys differently, so it is left to the filter.
+	if value == nil {
+		return nil
+	}
+
 	index.mutex.RLock()
 	defer index.mutex.RUnlock()
 
-	valueStr := valueToString(value)
-	if ids, exists := index.IndexMap[valueStr]; exists {
-		idsCopy := make([]string, len(ids))
-		copy(idsCopy, ids)
-		return idsCopy
+	// A multikey index only holds an array's elements, so it cannot tell
+	// which documents hold the whole array.
+	if _, isArray := value.([]interface{}); isArray && index.Multikey {
+		return nil
 	}
-	return nil
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, operand := range operandValues(value) {
+		for _, id := range index.IndexMap[indexKey(operand)] {
+			if !seen[id] {
+				result = append(result, id)
+				seen[id] = true
+			}
+		}
+	}
+	return result
 }
 
 func getFieldIdsFromOperators(index *IndexMetadata, operators map[string]interface{}) []string {
@@ -109,16 +382,13 @@ func getFieldIdsFromOperators(index *IndexMetadata, operators map[string]interfa
 	}
 
 	if inArr, ok := operators["$in"].([]interface{}); ok {
-		if len(inArr) == 0 {
-			return nil
-		}
 		result := make([]string, 0, len(inArr)*2)
 		seen := make(map[string]bool, len(inArr)*2)
 		for _, val := range inArr {
-			if val == nil {
-				continue
-			}
 			ids := getFieldIdsFromValue(index, val)
+			if ids == nil {
+				return nil
+			}
 			for _, id := range ids {
 				if !seen[id] {
 					result = append(result, id)
@@ -129,6 +399,10 @@ func getFieldIdsFromOperators(index *IndexMetadata, operators map[string]interfa
 		return result
 	}
 
+	if allArr, ok := operators["$all"].([]interface{}); ok {
+		return getFieldIdsFromAll(index, allArr)
+	}
+
 	if _, hasGte := operators["$gte"]; hasGte {
 		return getFieldIdsFromRange(index, operators)
 	}
@@ -142,172 +416,585 @@ func getFieldIdsFromOperators(index *IndexMetadata, operators map[string]interfa
 		return getFieldIdsFromRange(index, operators)
 	}
 
+	if ninArr, ok := operators["$nin"].([]interface{}); ok {
+		return getFieldIdsFromNin(index, ninArr)
+	}
+
 	return nil
 }
 
-func getFieldIdsFromRange(index *IndexMetadata, operators map[string]interface{}) []string {
-	var minValue, maxValue float64
-	var useMinInclusive, useMaxInclusive bool
-
-	if gte, ok := operators["$gte"].(float64); ok {
-		minValue = gte
-		useMinInclusive = true
-	} else if gt, ok := operators["$gt"].(float64); ok {
-		minValue = gt
-		useMinInclusive = false
-	} else {
-		minValue = -1e308
+// getFieldIdsFromAll intersects the documents under each value, which a
+// multikey index answers element by element. An empty $all matches nothing.
+func getFieldIdsFromAll(index *IndexMetadata, values []interface{}) []string {
+	var result []string
+	for _, val := range values {
+		if _, isOperator := isOperatorObject(val); isOperator {
+			return nil
+		}
+		ids := getFieldIdsFromValue(index, val)
+		if ids == nil {
+			return nil
+		}
+		if result == nil {
+			result = ids
+		} else {
+			result = intersectSlices(result, ids)
+		}
 	}
-
-	if lte, ok := operators["$lte"].(float64); ok {
-		maxValue = lte
-		useMaxInclusive = true
-	} else if lt, ok := operators["$lt"].(float64); ok {
-		maxValue = lt
-		useMaxInclusive = false
-	} else {
-		maxValue = 1e308
+	if result == nil {
+		return []string{}
 	}
+	return result
+}
 
+// getFieldIdsFromNin returns every indexed document except those under one
+// of the excluded keys. A document indexed under several keys is dropped if
+// any of them is excluded. A sparse index cannot answer it, since $nin also
+// matches the documents it leaves out.
+func getFieldIdsFromNin(index *IndexMetadata, excluded []interface{}) []string {
 	index.mutex.RLock()
-	sortedEntries := index.SortedEntries
-	index.mutex.RUnlock()
+	defer index.mutex.RUnlock()
 
-	if sortedEntries == nil {
-		index.mutex.Lock()
-		if index.SortedEntries == nil {
-			entries := make([]IndexEntry, 0, len(index.IndexMap))
-			for key, ids := range index.IndexMap {
-				if numVal := stringToNumber(key); numVal != nil {
-					entries = append(entries, IndexEntry{
-						Key:   *numVal,
-						Value: ids,
-					})
-				}
+	if index.Sparse {
+		return nil
+	}
+
+	skip := make(map[string]bool)
+	for _, val := range excluded {
+		for _, operand := range operandValues(val) {
+			for _, id := range index.IndexMap[indexKey(operand)] {
+				skip[id] = true
 			}
-			sort.Slice(entries, func(i, j int) bool {
-				valI, okI := toNumber(entries[i].Key)
-				valJ, okJ := toNumber(entries[j].Key)
-				if !okI || !okJ {
-					return false
-				}
-				return valI < valJ
-			})
-			index.SortedEntries = entries
 		}
-		sortedEntries = index.SortedEntries
-		index.mutex.Unlock()
 	}
 
-	if len(sortedEntries) == 0 {
-		return nil
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for node := index.Sorted.seekFirst(nil, false, true); node != nil; node = node.next[0] {
+		for _, id := range node.ids {
+			if !skip[id] && !seen[id] {
+				result = append(result, id)
+				seen[id] = true
+			}
+		}
 	}
+	return result
+}
 
-	result := make([]string, 0, len(sortedEntries))
-	seen := make(map[string]bool, len(sortedEntries))
-
-	for _, entry := range sortedEntries {
-		numVal, ok := toNumber(entry.Key)
-		if !ok {
-			continue
+// operandValues returns the values a condition's operand may stand for.
+// Dates reach the sidecar as timestamp strings, so such a string looks up, or
+// bounds, both the string and the date keys.
+func operandValues(value interface{}) []interface{} {
+	if str, ok := value.(string); ok {
+		if t, ok := parseTime(str); ok {
+			return []interface{}{str, t}
 		}
+	}
+	return []interface{}{value}
+}
+
+// classStart returns a key that sorts before every other key of its type, so
+// a range without a lower bound can still seek straight to its type.
+func classStart(class int) (interface{}, bool) {
+	switch class {
+	case keyClassNull:
+		return nil, true
+	case keyClassNumber:
+		return math.Inf(-1), true
+	case keyClassString:
+		return "", true
+	case keyClassBool:
+		return false, true
+	case keyClassDate:
+		return time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC), true
+	}
+	return nil, false
+}
+
+// keyRange is the part of a range condition that falls on keys of one type.
+type keyRange struct {
+	class        int
+	lower, upper keyBound
+}
+
+// rangeBrackets turns $gt/$gte/$lt/$lte into key ranges. Like MongoDB, a bound
+// only matches keys of its own type: {$gt: 5} never returns strings, and
+// bounds of two different types match nothing.
+func rangeBrackets(operators map[string]interface{}) []keyRange {
+	var lowerValue, upperValue interface{}
+	hasLower, hasUpper := false, false
+	lowerInclusive, upperInclusive := false, false
+
+	if gte, ok := operators["$gte"]; ok {
+		lowerValue, hasLower, lowerInclusive = gte, true, true
+	} else if gt, ok := operators["$gt"]; ok {
+		lowerValue, hasLower = gt, true
+	}
+	if lte, ok := operators["$lte"]; ok {
+		upperValue, hasUpper, upperInclusive = lte, true, true
+	} else if lt, ok := operators["$lt"]; ok {
+		upperValue, hasUpper = lt, true
+	}
 
-		matches := true
-		if minValue != -1e308 {
-			if useMinInclusive {
-				matches = numVal >= minValue
-			} else {
-				matches = numVal > minValue
+	var ranges []keyRange
+	switch {
+	case hasLower && hasUpper:
+		for _, lower := range operandValues(lowerValue) {
+			for _, upper := range operandValues(upperValue) {
+				if keyClass(lower) != keyClass(upper) {
+					continue
+				}
+				ranges = append(ranges, keyRange{
+					class: keyClass(lower),
+					lower: keyBound{key: lower, set: true, inclusive: lowerInclusive},
+					upper: keyBound{key: upper, set: true, inclusive: upperInclusive},
+				})
 			}
 		}
-		if matches && maxValue != 1e308 {
-			if useMaxInclusive {
-				matches = numVal <= maxValue
-			} else {
-				matches = numVal < maxValue
-			}
+	case hasLower:
+		for _, lower := range operandValues(lowerValue) {
+			ranges = append(ranges, keyRange{
+				class: keyClass(lower),
+				lower: keyBound{key: lower, set: true, inclusive: lowerInclusive},
+			})
 		}
+	case hasUpper:
+		for _, upper := range operandValues(upperValue) {
+			class := keyClass(upper)
+			start, ok := classStart(class)
+			ranges = append(ranges, keyRange{
+				class: class,
+				lower: keyBound{key: start, set: ok, inclusive: true},
+				upper: keyBound{key: upper, set: true, inclusive: upperInclusive},
+			})
+		}
+	}
+	return ranges
+}
 
-		if matches {
-			for _, id := range entry.Value {
+// contains reports whether value lies inside the range, and otherwise which
+// side of it value falls on: -1 below, 1 above, 0 for a key of another type.
+func (r keyRange) contains(value interface{}) (bool, int) {
+	class := keyClass(value)
+	if class != r.class {
+		return false, 0
+	}
+	if r.lower.set {
+		cmp := compareValues(value, r.lower.key)
+		if cmp < 0 || (cmp == 0 && !r.lower.inclusive) {
+			return false, -1
+		}
+	}
+	if r.upper.set {
+		cmp := compareValues(value, r.upper.key)
+		if cmp > 0 || (cmp == 0 && !r.upper.inclusive) {
+			return false, 1
+		}
+	}
+	return true, 0
+}
+
+func getFieldIdsFromRange(index *IndexMetadata, operators map[string]interface{}) []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	if (index.Multikey && isClosedRange(operators)) || (index.Sparse && hasNullBound(operators)) {
+		return nil
+	}
+
+	ranges := rangeBrackets(operators)
+	if len(ranges) == 0 {
+		return []string{}
+	}
+
+	// A range with only an upper bound is walked down from that bound, so it
+	// reads no keys below it; the walk ends at the first key of a lower type.
+	_, hasGt := operators["$gt"]
+	_, hasGte := operators["$gte"]
+	descending := !hasGt && !hasGte
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, r := range ranges {
+		visit := func(node *skipNode) bool {
+			if class := keyClass(node.key); class != r.class {
+				// Keys of other types are passed over until the walk has
+				// gone beyond the range's type.
+				return (class < r.class) != descending
+			}
+			for _, id := range node.ids {
 				if !seen[id] {
 					result = append(result, id)
 					seen[id] = true
 				}
 			}
-		} else if numVal > maxValue {
-			break
+			return true
+		}
+		if descending {
+			index.Sorted.Descend(r.lower, r.upper, visit)
+		} else {
+			index.Sorted.Ascend(r.lower, r.upper, visit)
 		}
 	}
 
 	return result
 }
 
-func GetCandidateIds(filterJSON string) string {
-	var filter map[string]interface{}
-	if err := json.Unmarshal([]byte(filterJSON), &filter); err != nil {
-		return `{"error":"` + err.Error() + `"}`
+// hasNullBound reports whether a range is bounded by null, which matches
+// documents without the field. A sparse index leaves those out, so it cannot
+// answer such a range.
+func hasNullBound(operators map[string]interface{}) bool {
+	for _, op := range []string{"$gt", "$gte", "$lt", "$lte"} {
+		if bound, ok := operators[op]; ok && bound == nil {
+			return true
+		}
 	}
+	return false
+}
 
-	resolver := getResolver()
-	resolver.mutex.RLock()
-	defer resolver.mutex.RUnlock()
+// isClosedRange reports whether operators bound a range on both sides. An
+// array matches such a range when one element meets the lower bound and
+// another the upper, so a multikey index, which looks at one element at a
+// time, would miss documents.
+func isClosedRange(operators map[string]interface{}) bool {
+	_, hasGt := operators["$gt"]
+	_, hasGte := operators["$gte"]
+	_, hasLt := operators["$lt"]
+	_, hasLte := operators["$lte"]
+	return (hasGt || hasGte) && (hasLt || hasLte)
+}
+
+// equalityValue reports whether a filter condition pins a field to a single
+// value, either directly or through $eq.
+func equalityValue(condition interface{}) (interface{}, bool) {
+	operators, ok := isOperatorObject(condition)
+	if !ok {
+		return condition, true
+	}
+	if eqVal, ok := operators["$eq"]; ok {
+		return eqVal, true
+	}
+	return nil, false
+}
 
-	var candidateIds []string
-	usedIndexes := make(map[string]bool, len(filter))
+// compoundBounds works out which part of a compound index a filter selects:
+// the key prefix fixed by equality conditions and the ranges, if any, on the
+// field after it. ok is false when the leading field is not constrained. Once
+// the index is multikey, it holds arrays by element, so the bounds stop at a
+// field compared with a whole array or bounded on both sides, as they do for
+// a single-field multikey index. The caller holds the read lock.
+func compoundBounds(index *IndexMetadata, filter map[string]interface{}) ([]interface{}, []keyRange, bool) {
+	prefix := make([]interface{}, 0, len(index.Fields))
+	var ranges []keyRange
+	hasRange := false
 
-	for field, value := range filter {
-		if len(field) > 0 && field[0] == '$' {
+	for _, field := range index.Fields {
+		condition, ok := filter[field]
+		if !ok {
+			break
+		}
+		if value, ok := equalityValue(condition); ok {
+			if _, isArray := value.([]interface{}); isArray && index.Multikey {
+				break
+			}
+			prefix = append(prefix, value)
 			continue
 		}
+		if operators, ok := isOperatorObject(condition); ok && !(index.Multikey && isClosedRange(operators)) {
+			ranges = rangeBrackets(operators)
+			hasRange = len(ranges) > 0
+		}
+		break
+	}
 
-		indexNames := resolver.FieldToIndex[field]
-		if len(indexNames) == 0 {
-			continue
+	return prefix, ranges, len(prefix) > 0 || hasRange
+}
+
+// getCompoundIds looks a filter up in a compound index. Equality conditions
+// on a leading run of the index's fields form a key prefix, and a range
+// condition on the field right after that prefix narrows it further. Returns
+// nil when the leading field is not constrained that way.
+func getCompoundIds(index *IndexMetadata, filter map[string]interface{}) []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	prefix, ranges, ok := compoundBounds(index, filter)
+	if !ok {
+		return nil
+	}
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	collect := func(node *skipNode) {
+		for _, id := range node.ids {
+			if !seen[id] {
+				result = append(result, id)
+				seen[id] = true
+			}
 		}
+	}
 
-		for _, indexName := range indexNames {
-			if usedIndexes[indexName] {
-				continue
+	inPrefix := func(tuple []interface{}) bool {
+		if len(tuple) < len(prefix) {
+			return false
+		}
+		for i, value := range prefix {
+			if compareValues(tuple[i], value) != 0 {
+				return false
 			}
+		}
+		return true
+	}
+
+	if len(ranges) == 0 {
+		for node := index.Sorted.seek(prefix); node != nil && inPrefix(indexTuple(node.key)); node = node.next[0] {
+			collect(node)
+		}
+		return result
+	}
+
+	// Within the prefix the trailing field runs in its index direction, so
+	// the scan starts at whichever bound comes first in that direction and
+	// stops once it passes the other one.
+	position := len(prefix)
+	descending := position < len(index.Directions) && index.Directions[position] < 0
+	for _, r := range ranges {
+		first := r.lower
+		if descending {
+			first = r.upper
+		}
+		seekKey := append(append(make([]interface{}, 0, position+1), prefix...), first.key)
+		if !first.set {
+			seekKey = seekKey[:position]
+		}
 
-			metadata := resolver.IndexMetadata[indexName]
-			if metadata == nil {
+		for node := index.Sorted.seek(seekKey); node != nil; node = node.next[0] {
+			tuple := indexTuple(node.key)
+			if !inPrefix(tuple) {
+				break
+			}
+			if len(tuple) <= position {
 				continue
 			}
-
-			var fieldIds []string
-			if valueMap, ok := value.(map[string]interface{}); ok {
-				fieldIds = getFieldIdsFromOperators(metadata, valueMap)
-			} else {
-				fieldIds = getFieldIdsFromValue(metadata, value)
+			inside, side := r.contains(tuple[position])
+			if inside {
+				collect(node)
+				continue
+			}
+			if (side > 0 && !descending) || (side < 0 && descending) {
+				break
 			}
+		}
+	}
+	return result
+}
 
-			if fieldIds == nil || len(fieldIds) == 0 {
-				continue
+// addID adds id under key in both the hash map and the ordered keys. The
+// caller holds the write lock.
+func (index *IndexMetadata) addID(key string, id string) {
+	ids := index.IndexMap[key]
+	for _, existing := range ids {
+		if existing == id {
+			return
+		}
+	}
+	ids = append(ids, id)
+	index.IndexMap[key] = ids
+	index.Sorted.Set(key, ids)
+	index.Postings++
+}
+
+// removeID removes id from key, dropping the key once no document is left
+// under it. The caller holds the write lock.
+func (index *IndexMetadata) removeID(key string, id string) {
+	ids, exists := index.IndexMap[key]
+	if !exists {
+		return
+	}
+	remaining := make([]string, 0, len(ids))
+	for _, existing := range ids {
+		if existing != id {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == len(ids) {
+		return
+	}
+	index.Postings -= len(ids) - len(remaining)
+	if len(remaining) == 0 {
+		delete(index.IndexMap, key)
+		index.Sorted.Delete(key)
+	} else {
+		index.IndexMap[key] = remaining
+		index.Sorted.Set(key, remaining)
+	}
+}
+
+func (resolver *IndexResolver) lookupIndexes(names []string) ([]*IndexMetadata, error) {
+	resolver.mutex.RLock()
+	defer resolver.mutex.RUnlock()
+
+	indexes := make([]*IndexMetadata, len(names))
+	for i, name := range names {
+		metadata := resolver.IndexMetadata[name]
+		if metadata == nil {
+			return nil, fmt.Errorf("unknown index: %s", name)
+		}
+		indexes[i] = metadata
+	}
+	return indexes, nil
+}
+
+func sortedKeys[V any](keys map[string]V) []string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lockIndexes write-locks indexes in name order, so concurrent writers that
+// lock overlapping sets cannot deadlock, and returns the matching unlock.
+func lockIndexes(indexes []*IndexMetadata) func() {
+	for _, index := range indexes {
+		index.mutex.Lock()
+	}
+	return func() {
+		for _, index := range indexes {
+			index.mutex.Unlock()
+		}
+	}
+}
+
+// skipsKey reports whether a sparse index leaves key out.
+func (index *IndexMetadata) skipsKey(key string) bool {
+	return index.Sparse && isNullKey(key)
+}
+
+// checkUnique returns a DuplicateKeyError if adding id under key would give a
+// unique index a second document for that key. The caller holds the lock.
+func (index *IndexMetadata) checkUnique(key string, id string) error {
+	if !index.Unique || index.skipsKey(key) {
+		return nil
+	}
+	for _, existing := range index.IndexMap[key] {
+		if existing != id {
+			return &DuplicateKeyError{Index: index.Name, Key: key, ID: id, ConflictingID: existing}
+		}
+	}
+	return nil
+}
+
+// indexInsert adds a document to the indexes named in keys, each mapped to
+// the document's key in that index. Unique indexes are all checked before any
+// index changes, so a duplicate key leaves every index as it was.
+func (resolver *IndexResolver) indexInsert(id string, keys map[string]string) error {
+	names := sortedKeys(keys)
+	indexes, err := resolver.lookupIndexes(names)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockIndexes(indexes)
+	defer unlock()
+
+	for i, index := range indexes {
+		for _, key := range index.elementKeys(keys[names[i]]) {
+			if err := index.checkUnique(key, id); err != nil {
+				return err
 			}
+		}
+	}
+	for i, index := range indexes {
+		for _, key := range index.documentKeys(keys[names[i]]) {
+			index.addID(key, id)
+		}
+	}
+	return nil
+}
+
+// indexDelete removes a document from the indexes named in keys.
+func (resolver *IndexResolver) indexDelete(id string, keys map[string]string) error {
+	names := sortedKeys(keys)
+	indexes, err := resolver.lookupIndexes(names)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockIndexes(indexes)
+	defer unlock()
+
+	for i, index := range indexes {
+		for _, key := range index.elementKeys(keys[names[i]]) {
+			index.removeID(key, id)
+		}
+	}
+	return nil
+}
+
+// indexUpdate moves a document from its old key to its new key in every
+// index named in either map. Keys the document keeps, including elements an
+// array value keeps, are left alone. As with indexInsert, a duplicate key in
+// any unique index changes nothing.
+func (resolver *IndexResolver) indexUpdate(id string, oldKeys, newKeys map[string]string) error {
+	all := make(map[string]bool, len(oldKeys)+len(newKeys))
+	for name := range oldKeys {
+		all[name] = true
+	}
+	for name := range newKeys {
+		all[name] = true
+	}
+	names := sortedKeys(all)
+	indexes, err := resolver.lookupIndexes(names)
+	if err != nil {
+		return err
+	}
 
-			usedIndexes[indexName] = true
+	unlock := lockIndexes(indexes)
+	defer unlock()
 
-			if candidateIds == nil {
-				candidateIds = fieldIds
-			} else {
-				candidateIds = intersectSlices(candidateIds, fieldIds)
-				if len(candidateIds) == 0 {
-					break
+	for i, index := range indexes {
+		if newKey, hasNew := newKeys[names[i]]; hasNew {
+			for _, key := range index.elementKeys(newKey) {
+				if err := index.checkUnique(key, id); err != nil {
+					return err
 				}
 			}
 		}
-		if candidateIds != nil && len(candidateIds) == 0 {
-			break
-		}
 	}
 
-	result := map[string]interface{}{
-		"ids": candidateIds,
+	for i, index := range indexes {
+		var before, after []string
+		if oldKey, hadOld := oldKeys[names[i]]; hadOld {
+			before = index.elementKeys(oldKey)
+		}
+		if newKey, hasNew := newKeys[names[i]]; hasNew {
+			after = index.documentKeys(newKey)
+		}
+
+		had := make(map[string]bool, len(before))
+		for _, key := range before {
+			had[key] = true
+		}
+		has := make(map[string]bool, len(after))
+		for _, key := range after {
+			has[key] = true
+		}
+
+		for _, key := range before {
+			if !has[key] {
+				index.removeID(key, id)
+			}
+		}
+		for _, key := range after {
+			if !had[key] {
+				index.addID(key, id)
+			}
+		}
 	}
-	resultJSON, _ := json.Marshal(result)
-	return string(resultJSON)
+	return nil
 }
 
 func intersectSlices(slice1, slice2 []string) []string {
@@ -342,11 +1029,3 @@ func valueToString(value interface{}) string {
 	data, _ := json.Marshal(value)
 	return string(data)
 }
-
-func stringToNumber(s string) *float64 {
-	var f float64
-	if err := json.Unmarshal([]byte(s), &f); err == nil {
-		return &f
-	}
-	return nil
-}
\ No newline at end of file
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func buildTestIndex(t *testing.T, name string, definition IndexDefinition, keys map[string][]string) *IndexMetadata {
+	t.Helper()
+	resolver := newIndexResolver()
+	if err := resolver.rebuildIndexMapping(map[string]map[string][]string{name: keys}, map[string]IndexDefinition{name: definition}); err != nil {
+		t.Fatal(err)
+	}
+	return resolver.IndexMetadata[name]
+}
+
+func TestIndexKeysKeepTheirType(t *testing.T) {
+	index := buildTestIndex(t, "v", IndexDefinition{}, map[string][]string{
+		`"150"`:                                {"string-150"},
+		`150`:                                  {"number-150"},
+		`"true"`:                               {"string-true"},
+		`true`:                                 {"bool-true"},
+		`"null"`:                               {"string-null"},
+		`null`:                                 {"null"},
+		`"2024-01-01T00:00:00Z"`:               {"string-date"},
+		`{"$date":"2024-01-01T00:00:00.000Z"}`: {"date"},
+	})
+
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"150", "string-150"},
+		{float64(150), "number-150"},
+		{"true", "string-true"},
+		{true, "bool-true"},
+		{"null", "string-null"},
+		{date, "date"},
+	}
+	for _, tt := range tests {
+		got := getFieldIdsFromValue(index, tt.value)
+		if !equalIDs(got, []string{tt.want}) {
+			t.Errorf("%#v: got %v, want [%s]", tt.value, got, tt.want)
+		}
+	}
+
+	got := getFieldIdsFromRange(index, map[string]interface{}{"$gte": float64(100)})
+	if !equalIDs(got, []string{"number-150"}) {
+		t.Errorf("$gte 100: got %v, want only the number", got)
+	}
+	if key := decodeIndexKey(`{"$date":"2024-01-01T00:00:00.000Z"}`); key != date {
+		t.Errorf("date key decoded as %#v", key)
+	}
+}
+
+// Filters carry dates as timestamp strings, so equality has to find both
+// the date keys and the string keys that hold the same timestamp.
+func TestDateKeysMatchTimestampStrings(t *testing.T) {
+	index := buildTestIndex(t, "d", IndexDefinition{}, map[string][]string{
+		`{"$date":"2024-01-01T00:00:00.000Z"}`: {"date"},
+		`"2024-01-01T00:00:00.000Z"`:           {"string"},
+		`{"$date":"2024-02-01T00:00:00.000Z"}`: {"other"},
+	})
+	timestamp := "2024-01-01T00:00:00.000Z"
+
+	tests := []struct {
+		name      string
+		condition interface{}
+		want      []string
+	}{
+		{"equality", timestamp, []string{"date", "string"}},
+		{"$eq", map[string]interface{}{"$eq": timestamp}, []string{"date", "string"}},
+		{"$in", map[string]interface{}{"$in": []interface{}{timestamp}}, []string{"date", "string"}},
+		{"$nin", map[string]interface{}{"$nin": []interface{}{timestamp}}, []string{"other"}},
+		{"$gte", map[string]interface{}{"$gte": timestamp}, []string{"date", "other", "string"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		if operators, ok := tt.condition.(map[string]interface{}); ok {
+			got = getFieldIdsFromOperators(index, operators)
+		} else {
+			got = getFieldIdsFromValue(index, tt.condition)
+		}
+		if !equalIDs(sortedIDs(got), tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+
+		estimate, ok := estimateCondition(index, map[string]interface{}{"d": tt.condition}, tt.condition)
+		if tt.name != "$gte" && (!ok || int(estimate) != len(tt.want)) {
+			t.Errorf("%s: estimated %v (ok %v), want %d", tt.name, estimate, ok, len(tt.want))
+		}
+	}
+}
+
+func TestParseIndexKey(t *testing.T) {
+	for raw, want := range map[string]string{
+		`1.0`:                                   `1`,
+		`"a"`:                                   `"a"`,
+		`[1, "b"]`:                              `[1,"b"]`,
+		`{"b":1,"a":2}`:                         `{"a":2,"b":1}`,
+		`{"$date": "2024-01-01T00:00:00.000Z"}`: `{"$date":"2024-01-01T00:00:00Z"}`,
+	} {
+		got, err := parseIndexKey(raw)
+		if err != nil {
+			t.Errorf("%s: %v", raw, err)
+		} else if got != want {
+			t.Errorf("%s: got %s, want %s", raw, got, want)
+		}
+	}
+
+	if _, err := parseIndexKey("active"); err == nil {
+		t.Error("a bare string was accepted as a key")
+	}
+}
+
+func TestSparseIndexKeepsStringNull(t *testing.T) {
+	resolver := newIndexResolver()
+	if err := resolver.rebuildIndexMapping(
+		map[string]map[string][]string{"v": {}},
+		map[string]IndexDefinition{"v": {Fields: []IndexField{{"v", 1}}, Unique: true, Sparse: true}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, key := range map[string]string{"missing-1": `null`, "missing-2": `null`, "string": `"null"`} {
+		if err := resolver.indexInsert(id, map[string]string{"v": key}); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+	}
+	index := resolver.IndexMetadata["v"]
+	if got := getFieldIdsFromValue(index, "null"); !equalIDs(got, []string{"string"}) {
+		t.Errorf(`"null": got %v, want [string]`, got)
+	}
+	if index.Postings != 1 {
+		t.Errorf("%d postings, want only the string", index.Postings)
+	}
+	if err := resolver.indexInsert("string-2", map[string]string{"v": `"null"`}); err == nil {
+		t.Error(`a second "null" was accepted by the unique index`)
+	}
+}
+
+// A sparse index leaves out documents without the field, which a null
+// bound matches, so it has to leave such conditions to the filter.
+func TestSparseIndexDeclinesNullConditions(t *testing.T) {
+	index := buildTestIndex(t, "v", IndexDefinition{Fields: []IndexField{{"v", 1}}, Sparse: true}, map[string][]string{
+		`null`: {"missing"},
+		`1`:    {"one"},
+	})
+	for _, operators := range []map[string]interface{}{
+		{"$gte": nil},
+		{"$lte": nil},
+		{"$gt": nil},
+		{"$lt": nil},
+		{"$in": []interface{}{nil, float64(1)}},
+		{"$eq": nil},
+		{"$nin": []interface{}{float64(1)}},
+	} {
+		if got := getFieldIdsFromOperators(index, operators); got != nil {
+			t.Errorf("%v: got %v, want the index to decline", operators, got)
+		}
+		if _, ok := estimateCondition(index, map[string]interface{}{"v": operators}, operators); ok {
+			t.Errorf("%v: estimated as answerable", operators)
+		}
+	}
+	if got := getFieldIdsFromOperators(index, map[string]interface{}{"$gte": float64(0)}); !equalIDs(got, []string{"one"}) {
+		t.Errorf("$gte 0: got %v, want [one]", got)
+	}
+}
+
+func TestUniqueIndexComparesKeyTypes(t *testing.T) {
+	resolver := newIndexResolver()
+	if err := resolver.rebuildIndexMapping(
+		map[string]map[string][]string{"v": {`5`: {"number"}}},
+		map[string]IndexDefinition{"v": {Fields: []IndexField{{"v", 1}}, Unique: true}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resolver.indexInsert("string", map[string]string{"v": `"5"`}); err != nil {
+		t.Errorf(`"5" conflicted with 5: %v`, err)
+	}
+	err := resolver.indexInsert("number-2", map[string]string{"v": `5`})
+	if duplicate, ok := err.(*DuplicateKeyError); !ok || duplicate.ConflictingID != "number" {
+		t.Errorf("5: got %v, want a conflict with number", err)
+	}
+
+	_, err = rebuildUniqueIndex(map[string][]string{`5`: {"a"}, `"5"`: {"b"}})
+	if err != nil {
+		t.Errorf("rebuild with 5 and \"5\": %v", err)
+	}
+	_, err = rebuildUniqueIndex(map[string][]string{`5`: {"a"}, `5.0`: {"b"}})
+	if _, ok := err.(*DuplicateKeyError); !ok {
+		t.Errorf("rebuild with 5 and 5.0: got %v, want a duplicate key", err)
+	}
+}
+
+func rebuildUniqueIndex(keys map[string][]string) (*IndexResolver, error) {
+	resolver := newIndexResolver()
+	return resolver, resolver.rebuildIndexMapping(
+		map[string]map[string][]string{"v": keys},
+		map[string]IndexDefinition{"v": {Fields: []IndexField{{"v", 1}}, Unique: true}},
+	)
+}
+
+func TestCompoundIndexExpandsArrays(t *testing.T) {
+	index := buildTestIndex(t, "a_b", IndexDefinition{Fields: []IndexField{{"a", 1}, {"b", 1}}}, map[string][]string{
+		`[[1,3],2]`: {"array"},
+		`[1,2]`:     {"scalar"},
+		`[[],2]`:    {"empty"},
+	})
+	if !index.Multikey {
+		t.Error("index with an array in a tuple is not multikey")
+	}
+
+	tests := []struct {
+		filter map[string]interface{}
+		want   []string
+	}{
+		{map[string]interface{}{"a": float64(1), "b": float64(2)}, []string{"array", "scalar"}},
+		{map[string]interface{}{"a": float64(3), "b": float64(2)}, []string{"array"}},
+		{map[string]interface{}{"a": float64(3)}, []string{"array"}},
+		{map[string]interface{}{"a": []interface{}{}, "b": float64(2)}, nil},
+		{map[string]interface{}{"a": float64(1), "b": map[string]interface{}{"$gte": float64(2)}}, []string{"array", "scalar"}},
+	}
+	for _, tt := range tests {
+		got := getCompoundIds(index, tt.filter)
+		if tt.want == nil {
+			if got != nil {
+				t.Errorf("%v: got %v, want the index to decline", tt.filter, got)
+			}
+			continue
+		}
+		if !equalIDs(sortedIDs(got), tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func sortedIDs(ids []string) []string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	return sorted
+}
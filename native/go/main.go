@@ -2,86 +2,237 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"runtime"
+	"sync"
+)
+
+const (
+	protocolVersion   = 3
+	maxInFlightFactor = 4
+	readBufferSize    = 64 * 1024
 )
 
 type Request struct {
+	ID     interface{}            `json:"id,omitempty"`
 	Method string                 `json:"method"`
 	Params map[string]interface{} `json:"params"`
 }
 
 type Response struct {
-	Result interface{} `json:"result"`
-	Error  string       `json:"error,omitempty"`
+	ID        interface{} `json:"id,omitempty"`
+	Result    interface{} `json:"result"`
+	Error     string      `json:"error,omitempty"`
+	ErrorCode string      `json:"code,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+	Partial   bool        `json:"partial,omitempty"`
+}
+
+// resultStream is a result too large to send at once. stream sends all but
+// the last part through emit, each as a partial response with the request's
+// id, and returns the last part as the result.
+type resultStream interface {
+	stream(emit func(part interface{})) (interface{}, error)
+}
+
+// codedError is an error that tells the client what went wrong in a form it
+// can act on, beyond the message. Its code and details are sent alongside the
+// error text.
+type codedError interface {
+	error
+	ErrorCode() string
+	ErrorDetails() interface{}
 }
 
+var (
+	stdin  = bufio.NewReaderSize(os.Stdin, readBufferSize)
+	stdout = bufio.NewWriter(os.Stdout)
+
+	conn   transport
+	enc    codec = jsonCodec{}
+	connMu sync.Mutex
+)
+
 func main() {
-	scanner := bufio.NewScanner(os.Stdin)
-	
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
+	maxFrameSize := flag.Int64("max-frame-size", defaultMaxFrameSize, "maximum size in bytes of a single request")
+	flag.Parse()
+
+	conn = newLineTransport(stdin, stdout, *maxFrameSize)
+	serve()
+}
+
+// serve answers requests read from conn until its input ends, and returns
+// once every request in flight has been answered.
+func serve() {
+	inFlight := make(chan struct{}, runtime.NumCPU()*maxInFlightFactor)
+	var wg sync.WaitGroup
+
+	for {
+		payload, headerID, err := conn.ReadMessage()
+		if err != nil {
+			var tooLarge *FrameTooLargeError
+			if errors.As(err, &tooLarge) {
+				resp := Response{Error: err.Error()}
+				if headerID != 0 {
+					resp.ID = headerID
+				}
+				respond(resp)
+				continue
+			}
+			if err != io.EOF {
+				respond(Response{Error: err.Error()})
+			}
+			break
+		}
+
+		if len(payload) == 0 {
+			continue
+		}
+
+		req, err := enc.DecodeRequest(payload)
+		if err != nil {
+			resp := Response{Error: err.Error()}
+			if headerID != 0 {
+				resp.ID = headerID
+			}
+			respond(resp)
+			continue
+		}
+		if req.ID == nil && headerID != 0 {
+			req.ID = headerID
+		}
+
+		// The handshake switches the transport, so everything already in
+		// flight has to be answered on the old one first.
+		if req.Method == "handshake" {
+			wg.Wait()
+			resp, nextConn, nextEnc := handshake(req)
+			respond(resp)
+			if nextConn != nil {
+				connMu.Lock()
+				conn = nextConn
+				enc = nextEnc
+				connMu.Unlock()
+			}
 			continue
 		}
 
-		var req Request
-		if err := json.Unmarshal([]byte(line), &req); err != nil {
-			respond(Response{Error: err.Error()})
+		// Requests without an id come from clients that read responses in
+		// order, so they are handled inline to keep that ordering.
+		if req.ID == nil {
+			respond(handleRequest(req))
 			continue
 		}
 
-		var resp Response
-
-		switch req.Method {
-		case "filterDocuments":
-			documentsJSON, _ := req.Params["documents"].(string)
-			filterJSON, _ := req.Params["filter"].(string)
-			maxResults, _ := req.Params["maxResults"].(float64)
-			result := FilterDocuments(documentsJSON, filterJSON, int(maxResults))
-			var resultData interface{}
-			json.Unmarshal([]byte(result), &resultData)
-			resp.Result = resultData
-
-		case "getCandidateIds":
-			filterJSON, _ := req.Params["filter"].(string)
-			result := GetCandidateIds(filterJSON)
-			var resultData interface{}
-			json.Unmarshal([]byte(result), &resultData)
-			resp.Result = resultData
-
-		case "rebuildIndexMapping":
-			indexesJSON, _ := req.Params["indexes"].(string)
-			RebuildIndexMapping(indexesJSON)
-			resp.Result = map[string]interface{}{"success": true}
-
-		case "sortDocuments":
-			documentsJSON, _ := req.Params["documents"].(string)
-			sortJSON, _ := req.Params["sort"].(string)
-			result := SortDocuments(documentsJSON, sortJSON)
-			var resultData interface{}
-			json.Unmarshal([]byte(result), &resultData)
-			resp.Result = resultData
-
-		case "projectDocuments":
-			documentsJSON, _ := req.Params["documents"].(string)
-			projectionJSON, _ := req.Params["projection"].(string)
-			result := ProjectDocuments(documentsJSON, projectionJSON)
-			var resultData interface{}
-			json.Unmarshal([]byte(result), &resultData)
-			resp.Result = resultData
-
-		default:
-			resp.Error = fmt.Sprintf("unknown method: %s", req.Method)
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func(req Request) {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			respond(handleRequest(req))
+		}(req)
+	}
+
+	wg.Wait()
+}
+
+func handleRequest(req Request) (resp Response) {
+	resp.ID = req.ID
+
+	defer func() {
+		if r := recover(); r != nil {
+			resp.Result = nil
+			resp.Error = fmt.Sprintf("panic in %s: %v", req.Method, r)
+		}
+	}()
+
+	handler, ok := methods[req.Method]
+	if !ok {
+		resp.Error = fmt.Sprintf("unknown method: %s", req.Method)
+		return resp
+	}
+
+	result, err := handler(req.Params)
+	if stream, ok := result.(resultStream); ok && err == nil {
+		result, err = stream.stream(func(part interface{}) {
+			respond(Response{ID: req.ID, Result: part, Partial: true})
+		})
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		var coded codedError
+		if errors.As(err, &coded) {
+			resp.ErrorCode = coded.ErrorCode()
+			resp.Details = coded.ErrorDetails()
+		}
+		return resp
+	}
+	resp.Result = result
+
+	return resp
+}
+
+func handshake(req Request) (Response, transport, codec) {
+	resp := Response{ID: req.ID}
+
+	maxSize := conn.MaxFrameSize()
+	if requested, ok := req.Params["maxFrameSize"].(float64); ok && requested > 0 {
+		maxSize = int64(requested)
+	}
+
+	framing, _ := req.Params["framing"].(string)
+	if framing == "" {
+		framing = conn.Framing()
+	}
+
+	encoding, _ := req.Params["encoding"].(string)
+	if encoding == "" {
+		encoding = enc.Name()
+	}
+	nextEnc, err := codecByName(encoding)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp, nil, nil
+	}
+
+	var nextConn transport
+	switch framing {
+	case framingLine:
+		// Binary payloads can contain newlines, so they need real frames.
+		if encoding != encodingJSON {
+			resp.Error = fmt.Sprintf("encoding %s requires %s framing", encoding, framingLength)
+			return resp, nil, nil
 		}
+		nextConn = newLineTransport(stdin, stdout, maxSize)
+	case framingLength:
+		nextConn = newFrameTransport(stdin, stdout, maxSize)
+	default:
+		resp.Error = fmt.Sprintf("unsupported framing: %s", framing)
+		return resp, nil, nil
+	}
 
-		respond(resp)
+	resp.Result = map[string]interface{}{
+		"version":      protocolVersion,
+		"framing":      framing,
+		"encoding":     encoding,
+		"maxFrameSize": maxSize,
 	}
+	return resp, nextConn, nextEnc
 }
 
 func respond(resp Response) {
-	data, _ := json.Marshal(resp)
-	fmt.Println(string(data))
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	data, err := enc.EncodeResponse(resp)
+	if err != nil {
+		data, _ = enc.EncodeResponse(Response{ID: resp.ID, Error: err.Error()})
+	}
+	conn.WriteMessage(data, frameID(resp.ID))
 }
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var errMsgpackTruncated = errors.New("msgpack: unexpected end of data")
+
+// Numbers are always decoded as float64 so that values coming from MessagePack
+// look exactly like values coming from encoding/json.
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	buf := make([]byte, 0, 512)
+	return msgpackAppend(buf, v)
+}
+
+// Nil slices and maps are encoded as nil, as encoding/json writes them as
+// null: an absent list and an empty one mean different things to callers.
+func msgpackAppend(buf []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if val {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case string:
+		return msgpackAppendString(buf, val), nil
+	case []byte:
+		if val == nil {
+			return append(buf, 0xc0), nil
+		}
+		return msgpackAppendBinary(buf, val), nil
+	case float64:
+		return msgpackAppendFloat(buf, val), nil
+	case float32:
+		return msgpackAppendFloat(buf, float64(val)), nil
+	case int:
+		return msgpackAppendInt(buf, int64(val)), nil
+	case int32:
+		return msgpackAppendInt(buf, int64(val)), nil
+	case int64:
+		return msgpackAppendInt(buf, val), nil
+	case uint32:
+		return msgpackAppendInt(buf, int64(val)), nil
+	case time.Time:
+		return msgpackAppendString(buf, val.Format(time.RFC3339Nano)), nil
+	case json.Number:
+		f, err := val.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return msgpackAppendFloat(buf, f), nil
+	case []interface{}:
+		if val == nil {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendArrayHeader(buf, len(val))
+		for _, item := range val {
+			var err error
+			if buf, err = msgpackAppend(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case []string:
+		if val == nil {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendArrayHeader(buf, len(val))
+		for _, item := range val {
+			buf = msgpackAppendString(buf, item)
+		}
+		return buf, nil
+	case []map[string]interface{}:
+		if val == nil {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendArrayHeader(buf, len(val))
+		for _, item := range val {
+			var err error
+			if buf, err = msgpackAppend(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		if val == nil {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendMapHeader(buf, len(val))
+		for key, item := range val {
+			buf = msgpackAppendString(buf, key)
+			var err error
+			if buf, err = msgpackAppend(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	return msgpackAppendReflect(buf, reflect.ValueOf(v))
+}
+
+func msgpackAppendReflect(buf []byte, rv reflect.Value) ([]byte, error) {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		return msgpackAppend(buf, rv.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return msgpackAppendInt(buf, rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return msgpackAppendFloat(buf, float64(rv.Uint())), nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendArrayHeader(buf, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			var err error
+			if buf, err = msgpackAppend(buf, rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("msgpack: unsupported map key type %s", rv.Type().Key())
+		}
+		if rv.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendMapHeader(buf, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			buf = msgpackAppendString(buf, iter.Key().String())
+			var err error
+			if buf, err = msgpackAppend(buf, iter.Value().Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		if _, ok := rv.Interface().(json.Marshaler); !ok {
+			return msgpackAppendStruct(buf, rv)
+		}
+	}
+
+	// Anything else (custom marshalers, exotic kinds) goes through its JSON form.
+	data, err := json.Marshal(rv.Interface())
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return msgpackAppend(buf, generic)
+}
+
+func msgpackAppendStruct(buf []byte, rv reflect.Value) ([]byte, error) {
+	type field struct {
+		name  string
+		value reflect.Value
+	}
+
+	rt := rv.Type()
+	fields := make([]field, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		value := rv.Field(i)
+		if strings.Contains(opts, "omitempty") && value.IsZero() {
+			continue
+		}
+		fields = append(fields, field{name: name, value: value})
+	}
+
+	buf = msgpackAppendMapHeader(buf, len(fields))
+	for _, f := range fields {
+		buf = msgpackAppendString(buf, f.name)
+		var err error
+		if buf, err = msgpackAppend(buf, f.value.Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func msgpackAppendFloat(buf []byte, f float64) []byte {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && !(f == 0 && math.Signbit(f)) {
+		return msgpackAppendInt(buf, int64(f))
+	}
+	buf = append(buf, 0xcb)
+	return binary.BigEndian.AppendUint64(buf, math.Float64bits(f))
+}
+
+func msgpackAppendInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n < 0 && n >= -32:
+		return append(buf, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf = append(buf, 0xd1)
+		return binary.BigEndian.AppendUint16(buf, uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf = append(buf, 0xd2)
+		return binary.BigEndian.AppendUint32(buf, uint32(n))
+	}
+	buf = append(buf, 0xd3)
+	return binary.BigEndian.AppendUint64(buf, uint64(n))
+}
+
+func msgpackAppendString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xda)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0xdb)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func msgpackAppendBinary(buf []byte, b []byte) []byte {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xc5)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0xc6)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+	}
+	return append(buf, b...)
+}
+
+func msgpackAppendArrayHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xdc)
+		return binary.BigEndian.AppendUint16(buf, uint16(n))
+	}
+	buf = append(buf, 0xdd)
+	return binary.BigEndian.AppendUint32(buf, uint32(n))
+}
+
+func msgpackAppendMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xde)
+		return binary.BigEndian.AppendUint16(buf, uint16(n))
+	}
+	buf = append(buf, 0xdf)
+	return binary.BigEndian.AppendUint32(buf, uint32(n))
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func msgpackUnmarshal(data []byte) (interface{}, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	tag := b[0]
+
+	switch {
+	case tag <= 0x7f:
+		return float64(tag), nil
+	case tag >= 0xe0:
+		return float64(int8(tag)), nil
+	case tag&0xe0 == 0xa0:
+		return d.string(int(tag & 0x1f))
+	case tag&0xf0 == 0x90:
+		return d.array(int(tag & 0x0f))
+	case tag&0xf0 == 0x80:
+		return d.object(int(tag & 0x0f))
+	}
+
+	switch tag {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (tag - 0xcc))
+		return float64(n), err
+	case 0xd0:
+		n, err := d.uint(1)
+		return float64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return float64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return float64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return float64(int64(n)), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (tag - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.string(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (tag - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), raw...), nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (tag - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (tag - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x at offset %d", tag, d.pos-1)
+}
+
+func (d *msgpackDecoder) string(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) array(n int) ([]interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	arr := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) object(n int) (map[string]interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	obj := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		keyStr, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key must be a string, got %T", key)
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		obj[keyStr] = v
+	}
+	return obj, nil
+}
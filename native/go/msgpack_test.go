@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want interface{}
+	}{
+		{"nil", nil, nil},
+		{"bool", true, true},
+		{"int as double", 42, float64(42)},
+		{"negative int", int64(-7), float64(-7)},
+		{"double", 1.5, 1.5},
+		{"string", "hello", "hello"},
+		{"empty array", []interface{}{}, []interface{}{}},
+		{"array", []interface{}{"a", 1.0, nil}, []interface{}{"a", 1.0, nil}},
+		{"strings", []string{"a", "b"}, []interface{}{"a", "b"}},
+		{"empty strings", []string{}, []interface{}{}},
+		{"nil strings", []string(nil), nil},
+		{"nil array", []interface{}(nil), nil},
+		{"nil documents", []map[string]interface{}(nil), nil},
+		{"nil object", map[string]interface{}(nil), nil},
+		{"nil bytes", []byte(nil), nil},
+		{"nil typed slice", []int(nil), nil},
+		{"nil typed map", map[string]int(nil), nil},
+		{
+			"object",
+			map[string]interface{}{"ids": []string(nil), "empty": []string{}, "n": 3},
+			map[string]interface{}{"ids": nil, "empty": []interface{}{}, "n": float64(3)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := msgpackMarshal(tt.in)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			got, err := msgpackUnmarshal(data)
+			if err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A collection without indexes has no candidate ids, which clients read as
+// "scan everything". It must not reach them as an empty list, which means
+// nothing can match.
+func TestMsgpackCandidateIdsWithoutResolver(t *testing.T) {
+	result, err := handleGetCandidateIds(map[string]interface{}{
+		"collection": "msgpack-test-unindexed",
+		"filter":     map[string]interface{}{"status": "active"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := msgpackCodec{}.EncodeResponse(Response{ID: 1.0, Result: result})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msgpackUnmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := decoded.(map[string]interface{})["result"].(map[string]interface{})
+	if ids, present := got["ids"]; !present || ids != nil {
+		t.Errorf("ids = %#v (present %v), want nil", ids, present)
+	}
+}
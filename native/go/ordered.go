@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	skipListMaxLevel = 32
+	skipListP        = 0.25
+)
+
+// Values are ordered by type first and by value within a type, following
+// MongoDB's comparison order: null, numbers, strings, objects, arrays,
+// booleans, dates. Sorting, range filters and index keys all use this order.
+const (
+	keyClassNull = iota
+	keyClassNumber
+	keyClassString
+	keyClassObject
+	keyClassArray
+	keyClassBool
+	keyClassDate
+)
+
+func keyClass(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return keyClassNull
+	case string:
+		return keyClassString
+	case map[string]interface{}:
+		return keyClassObject
+	case []interface{}:
+		return keyClassArray
+	case bool:
+		return keyClassBool
+	case time.Time:
+		return keyClassDate
+	}
+	if _, ok := toNumber(v); ok {
+		return keyClassNumber
+	}
+	return keyClassObject
+}
+
+// compareValues is a total order over document values: it returns a negative
+// number, zero or a positive number as a sorts before, with or after b.
+// Missing fields compare as null. NaN sorts before every other number, so
+// that equal values always compare equal. Objects compare field by field in
+// key order and arrays element by element, the shorter first on a tie.
+func compareValues(a, b interface{}) int {
+	classA, classB := keyClass(a), keyClass(b)
+	if classA != classB {
+		if classA < classB {
+			return -1
+		}
+		return 1
+	}
+
+	switch classA {
+	case keyClassNumber:
+		numA, _ := toNumber(a)
+		numB, _ := toNumber(b)
+		nanA, nanB := math.IsNaN(numA), math.IsNaN(numB)
+		switch {
+		case nanA || nanB:
+			return compareBools(!nanA, !nanB)
+		case numA < numB:
+			return -1
+		case numA > numB:
+			return 1
+		}
+		return 0
+	case keyClassString:
+		return strings.Compare(a.(string), b.(string))
+	case keyClassBool:
+		return compareBools(a.(bool), b.(bool))
+	case keyClassDate:
+		return a.(time.Time).Compare(b.(time.Time))
+	case keyClassArray:
+		return compareArrays(a.([]interface{}), b.([]interface{}))
+	case keyClassObject:
+		objA, okA := a.(map[string]interface{})
+		objB, okB := b.(map[string]interface{})
+		if !okA || !okB {
+			jsonA, _ := json.Marshal(a)
+			jsonB, _ := json.Marshal(b)
+			return strings.Compare(string(jsonA), string(jsonB))
+		}
+		return compareObjects(objA, objB)
+	}
+	return 0
+}
+
+// compareBools orders false before true.
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	}
+	return 1
+}
+
+func compareArrays(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if cmp := compareValues(a[i], b[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(a) - len(b)
+}
+
+// compareObjects compares the fields of two objects in key order, name
+// first and then value. Decoded objects do not keep their field order, so
+// key order stands in for it.
+func compareObjects(a, b map[string]interface{}) int {
+	keysA, keysB := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(keysA) && i < len(keysB); i++ {
+		if cmp := strings.Compare(keysA[i], keysB[i]); cmp != 0 {
+			return cmp
+		}
+		if cmp := compareValues(a[keysA[i]], b[keysB[i]]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(keysA) - len(keysB)
+}
+
+// compareInClass compares values of the same type, as range operators do:
+// $gt on a string only matches strings. A timestamp string and a date are
+// compared as dates, since dates arrive as strings. ok is false when the
+// values cannot be compared.
+func compareInClass(a, b interface{}) (cmp int, ok bool) {
+	if keyClass(a) == keyClass(b) {
+		return compareValues(a, b), true
+	}
+	timeA, isTimeA := a.(time.Time)
+	timeB, isTimeB := b.(time.Time)
+	switch {
+	case isTimeA && !isTimeB:
+		if timeB, ok := parseTime(b); ok {
+			return timeA.Compare(timeB), true
+		}
+	case isTimeB && !isTimeA:
+		if timeA, ok := parseTime(a); ok {
+			return timeA.Compare(timeB), true
+		}
+	}
+	return 0, false
+}
+
+// Index keys are JSON text, so the string "5" and the number 5 are
+// different keys. A date is written as {"$date": timestamp}, which keeps it
+// apart from a string that happens to hold a timestamp.
+
+// indexKey encodes a value as a key in the index mapping.
+func indexKey(value interface{}) string {
+	data, _ := json.Marshal(tagDates(value))
+	return string(data)
+}
+
+// decodeIndexKey recovers the typed value of a key in the index mapping.
+func decodeIndexKey(key string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(key), &value); err != nil {
+		return key
+	}
+	return untagDates(value)
+}
+
+// parseIndexKey reads a key sent by a client and re-encodes it, so that
+// equal values written differently, such as 1 and 1.0, share one key.
+func parseIndexKey(raw string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return "", fmt.Errorf("index key %q is not valid JSON", raw)
+	}
+	return indexKey(untagDates(value)), nil
+}
+
+func tagDates(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return map[string]interface{}{"$date": v.UTC().Format(time.RFC3339Nano)}
+	case []interface{}:
+		tagged := make([]interface{}, len(v))
+		for i, element := range v {
+			tagged[i] = tagDates(element)
+		}
+		return tagged
+	case map[string]interface{}:
+		tagged := make(map[string]interface{}, len(v))
+		for name, field := range v {
+			tagged[name] = tagDates(field)
+		}
+		return tagged
+	}
+	return value
+}
+
+func untagDates(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, element := range v {
+			v[i] = untagDates(element)
+		}
+	case map[string]interface{}:
+		if date, ok := v["$date"].(string); ok && len(v) == 1 {
+			if t, ok := parseTime(date); ok {
+				return t
+			}
+		}
+		for name, field := range v {
+			v[name] = untagDates(field)
+		}
+	}
+	return value
+}
+
+func indexTuple(key interface{}) []interface{} {
+	if tuple, ok := key.([]interface{}); ok {
+		return tuple
+	}
+	return []interface{}{key}
+}
+
+// tupleComparator orders compound index keys field by field, honouring each
+// field's direction. A shorter key compares equal to every key it is a
+// prefix of, which is what lets a lookup seek on the leading fields alone.
+func tupleComparator(directions []int) func(a, b interface{}) int {
+	return func(a, b interface{}) int {
+		tupleA, tupleB := indexTuple(a), indexTuple(b)
+		for i := 0; i < len(tupleA) && i < len(tupleB); i++ {
+			cmp := compareValues(tupleA[i], tupleB[i])
+			if cmp == 0 {
+				continue
+			}
+			if i < len(directions) && directions[i] < 0 {
+				return -cmp
+			}
+			return cmp
+		}
+		return 0
+	}
+}
+
+type skipNode struct {
+	raw  string
+	key  interface{}
+	ids  []string
+	next []*skipNode
+	prev *skipNode
+}
+
+// skipList keeps an index's keys in order so range lookups seek to the first
+// key in range in O(log n) and then walk forwards or backwards. Nodes are
+// identified by the key as it appears in the index mapping, since distinct
+// keys such as "1" and "1.0" decode to the same value. It is not safe for
+// concurrent use; IndexMetadata guards it with its mutex.
+type skipList struct {
+	compare func(a, b interface{}) int
+	head    *skipNode
+	tail    *skipNode
+	level   int
+	length  int
+	rng     *rand.Rand
+}
+
+func newSkipList(compare func(a, b interface{}) int) *skipList {
+	return &skipList{
+		compare: compare,
+		head:    &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level:   1,
+		rng:     rand.New(rand.NewSource(1)),
+	}
+}
+
+func (s *skipList) Len() int {
+	return s.length
+}
+
+func (s *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rng.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+func (s *skipList) compareNode(node *skipNode, key interface{}, raw string) int {
+	if cmp := s.compare(node.key, key); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(node.raw, raw)
+}
+
+// findPredecessors fills update with the last node before (key, raw) on each
+// level and returns the node after it.
+func (s *skipList) findPredecessors(key interface{}, raw string, update []*skipNode) *skipNode {
+	node := s.head
+	for level := s.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && s.compareNode(node.next[level], key, raw) < 0 {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// seek returns the first node whose key is not below key.
+func (s *skipList) seek(key interface{}) *skipNode {
+	node := s.head
+	for level := s.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && s.compare(node.next[level].key, key) < 0 {
+			node = node.next[level]
+		}
+	}
+	return node.next[0]
+}
+
+// Set stores ids under the raw index key, adding it if it is new.
+func (s *skipList) Set(raw string, ids []string) {
+	key := decodeIndexKey(raw)
+	update := make([]*skipNode, skipListMaxLevel)
+	node := s.findPredecessors(key, raw, update)
+	if node != nil && node.raw == raw {
+		node.ids = ids
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+
+	node = &skipNode{raw: raw, key: key, ids: ids, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	if update[0] != s.head {
+		node.prev = update[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		s.tail = node
+	}
+	s.length++
+}
+
+func (s *skipList) Delete(raw string) bool {
+	key := decodeIndexKey(raw)
+	update := make([]*skipNode, skipListMaxLevel)
+	node := s.findPredecessors(key, raw, update)
+	if node == nil || node.raw != raw {
+		return false
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		s.tail = node.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	return true
+}
+
+// seekFirst returns the first node at or after key, or strictly after it
+// when inclusive is false. Without a key it starts at the front.
+func (s *skipList) seekFirst(key interface{}, hasKey, inclusive bool) *skipNode {
+	if !hasKey {
+		return s.head.next[0]
+	}
+	node := s.seek(key)
+	for !inclusive && node != nil && s.compare(node.key, key) == 0 {
+		node = node.next[0]
+	}
+	return node
+}
+
+// seekLast returns the last node at or before key, or strictly before it
+// when inclusive is false. Without a key it starts at the back.
+func (s *skipList) seekLast(key interface{}, hasKey, inclusive bool) *skipNode {
+	if !hasKey {
+		return s.tail
+	}
+	node := s.seek(key)
+	if inclusive {
+		for node != nil && s.compare(node.key, key) == 0 {
+			node = node.next[0]
+		}
+	}
+	if node == nil {
+		return s.tail
+	}
+	return node.prev
+}
+
+// keyBound is one end of a key range.
+type keyBound struct {
+	key       interface{}
+	set       bool
+	inclusive bool
+}
+
+// Ascend calls fn for each node between lower and upper in ascending key
+// order until fn returns false.
+func (s *skipList) Ascend(lower, upper keyBound, fn func(node *skipNode) bool) {
+	for node := s.seekFirst(lower.key, lower.set, lower.inclusive); node != nil; node = node.next[0] {
+		if upper.set {
+			cmp := s.compare(node.key, upper.key)
+			if cmp > 0 || (cmp == 0 && !upper.inclusive) {
+				return
+			}
+		}
+		if !fn(node) {
+			return
+		}
+	}
+}
+
+// Descend is Ascend in descending key order.
+func (s *skipList) Descend(lower, upper keyBound, fn func(node *skipNode) bool) {
+	for node := s.seekLast(upper.key, upper.set, upper.inclusive); node != nil; node = node.prev {
+		if lower.set {
+			cmp := s.compare(node.key, lower.key)
+			if cmp < 0 || (cmp == 0 && !lower.inclusive) {
+				return
+			}
+		}
+		if !fn(node) {
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func skipListKeys(walk func(lower, upper keyBound, fn func(node *skipNode) bool), lower, upper keyBound) []interface{} {
+	var keys []interface{}
+	walk(lower, upper, func(node *skipNode) bool {
+		keys = append(keys, node.key)
+		return true
+	})
+	return keys
+}
+
+func TestSkipListWalksBothWays(t *testing.T) {
+	s := newSkipList(compareValues)
+	for _, raw := range []string{`"b"`, `3`, `null`, `1`, `"a"`, `2`, `true`, `5`} {
+		s.Set(raw, []string{raw})
+	}
+	s.Delete(`5`)
+
+	all := []interface{}{nil, 1.0, 2.0, 3.0, "a", "b", true}
+	if got := skipListKeys(s.Ascend, keyBound{}, keyBound{}); !reflect.DeepEqual(got, all) {
+		t.Errorf("ascending: got %v, want %v", got, all)
+	}
+	reversed := make([]interface{}, len(all))
+	for i, key := range all {
+		reversed[len(all)-1-i] = key
+	}
+	if got := skipListKeys(s.Descend, keyBound{}, keyBound{}); !reflect.DeepEqual(got, reversed) {
+		t.Errorf("descending: got %v, want %v", got, reversed)
+	}
+
+	tests := []struct {
+		lower, upper keyBound
+		want         []interface{}
+	}{
+		{keyBound{key: 1.0, set: true, inclusive: true}, keyBound{key: 3.0, set: true, inclusive: true}, []interface{}{3.0, 2.0, 1.0}},
+		{keyBound{key: 1.0, set: true}, keyBound{key: 3.0, set: true}, []interface{}{2.0}},
+		{keyBound{}, keyBound{key: 2.0, set: true}, []interface{}{1.0, nil}},
+		{keyBound{key: "a", set: true}, keyBound{}, []interface{}{true, "b"}},
+		{keyBound{}, keyBound{key: 10.0, set: true, inclusive: true}, []interface{}{3.0, 2.0, 1.0, nil}},
+	}
+	for _, tt := range tests {
+		if got := skipListKeys(s.Descend, tt.lower, tt.upper); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("descend %+v..%+v: got %v, want %v", tt.lower, tt.upper, got, tt.want)
+		}
+	}
+}
+
+func TestUpperBoundedRangeStaysInType(t *testing.T) {
+	index := buildTestIndex(t, "v", IndexDefinition{}, map[string][]string{
+		`null`: {"null"},
+		`1`:    {"one"},
+		`4`:    {"four"},
+		`9`:    {"nine"},
+		`"a"`:  {"a"},
+		`"m"`:  {"m"},
+		`true`: {"true"},
+	})
+
+	tests := []struct {
+		operators map[string]interface{}
+		want      []string
+	}{
+		{map[string]interface{}{"$lt": float64(5)}, []string{"four", "one"}},
+		{map[string]interface{}{"$lte": float64(4)}, []string{"four", "one"}},
+		{map[string]interface{}{"$lt": "m"}, []string{"a"}},
+		{map[string]interface{}{"$lte": "z"}, []string{"a", "m"}},
+		{map[string]interface{}{"$lt": float64(0)}, []string{}},
+	}
+	for _, tt := range tests {
+		got := getFieldIdsFromRange(index, tt.operators)
+		if !equalIDs(sortedIDs(got), tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.operators, got, tt.want)
+		}
+	}
+}
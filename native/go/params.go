@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Params may arrive either as JSON strings (the original protocol) or as
+// already-decoded values, which is what the binary encoding sends.
+
+func documentsParam(params map[string]interface{}, name string) ([]map[string]interface{}, error) {
+	switch raw := params[name].(type) {
+	case string:
+		var documents []map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &documents); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return documents, nil
+	case []interface{}:
+		documents := make([]map[string]interface{}, len(raw))
+		for i, item := range raw {
+			doc, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid %s: element %d is not an object", name, i)
+			}
+			documents[i] = doc
+		}
+		return documents, nil
+	case nil:
+		return nil, fmt.Errorf("missing parameter: %s", name)
+	default:
+		return nil, fmt.Errorf("invalid %s: expected an array, got %T", name, raw)
+	}
+}
+
+func objectParam(params map[string]interface{}, name string) (map[string]interface{}, error) {
+	switch raw := params[name].(type) {
+	case string:
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return obj, nil
+	case map[string]interface{}:
+		return raw, nil
+	case nil:
+		return nil, fmt.Errorf("missing parameter: %s", name)
+	default:
+		return nil, fmt.Errorf("invalid %s: expected an object, got %T", name, raw)
+	}
+}
+
+func optionalObjectParam(params map[string]interface{}, name string) (map[string]interface{}, error) {
+	if raw, ok := params[name]; !ok || raw == nil || raw == "" {
+		return nil, nil
+	}
+	return objectParam(params, name)
+}
+
+func stringParam(params map[string]interface{}, name string) (string, error) {
+	switch raw := params[name].(type) {
+	case string:
+		if raw == "" {
+			return "", fmt.Errorf("missing parameter: %s", name)
+		}
+		return raw, nil
+	case nil:
+		return "", fmt.Errorf("missing parameter: %s", name)
+	default:
+		return "", fmt.Errorf("invalid %s: expected a string, got %T", name, raw)
+	}
+}
+
+func stringsParam(params map[string]interface{}, name string) ([]string, error) {
+	switch raw := params[name].(type) {
+	case string:
+		var values []string
+		if err := json.Unmarshal([]byte(raw), &values); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return values, nil
+	case nil:
+		return nil, fmt.Errorf("missing parameter: %s", name)
+	default:
+		values, err := stringSlice(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return values, nil
+	}
+}
+
+// scopeParam reads the collection a call applies to and the optional
+// database path that qualifies it. Resident documents and indexes are both
+// kept per database and collection.
+func scopeParam(params map[string]interface{}) (string, string, error) {
+	collection, err := stringParam(params, "collection")
+	if err != nil {
+		return "", "", err
+	}
+	database, ok := params["database"].(string)
+	if raw, present := params["database"]; present && raw != nil && !ok {
+		return "", "", fmt.Errorf("invalid database: expected a string, got %T", raw)
+	}
+	return database, collection, nil
+}
+
+// indexResolverParam returns the resolver of the collection named in params,
+// which must already have had its indexes loaded.
+func indexResolverParam(params map[string]interface{}) (*IndexResolver, error) {
+	database, collection, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	resolver := getResolver(database, collection)
+	if resolver == nil {
+		return nil, &NoIndexesError{Collection: collection}
+	}
+	return resolver, nil
+}
+
+// sortParam reads a required sort spec; see parseSort for the forms it takes.
+func sortParam(params map[string]interface{}, name string) ([]SortField, error) {
+	if params[name] == nil {
+		return nil, fmt.Errorf("missing parameter: %s", name)
+	}
+	return optionalSortParam(params, name)
+}
+
+func optionalSortParam(params map[string]interface{}, name string) ([]SortField, error) {
+	fields, err := parseSort(params[name])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return fields, nil
+}
+
+func intParam(params map[string]interface{}, name string, fallback int) int {
+	if value, ok := params[name].(float64); ok {
+		return int(value)
+	}
+	return fallback
+}
+
+func boolParam(params map[string]interface{}, name string) bool {
+	value, _ := params[name].(bool)
+	return value
+}
+
+func indexesParam(params map[string]interface{}, name string) (map[string]map[string][]string, error) {
+	switch raw := params[name].(type) {
+	case string:
+		var indexes map[string]map[string][]string
+		if err := json.Unmarshal([]byte(raw), &indexes); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return indexes, nil
+	case map[string]interface{}:
+		indexes := make(map[string]map[string][]string, len(raw))
+		for indexName, rawIndex := range raw {
+			indexObj, ok := rawIndex.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid %s: index %s is not an object", name, indexName)
+			}
+			indexMap := make(map[string][]string, len(indexObj))
+			for key, rawIds := range indexObj {
+				ids, err := stringSlice(rawIds)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s: index %s key %s: %w", name, indexName, key, err)
+				}
+				indexMap[key] = ids
+			}
+			indexes[indexName] = indexMap
+		}
+		return indexes, nil
+	case nil:
+		return nil, fmt.Errorf("missing parameter: %s", name)
+	default:
+		return nil, fmt.Errorf("invalid %s: expected an object, got %T", name, raw)
+	}
+}
+
+// indexKeysParam reads index name -> key, where each key is JSON text, and
+// returns the keys the way the indexes store them.
+func indexKeysParam(params map[string]interface{}, name string) (map[string]string, error) {
+	obj, err := objectParam(params, name)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string, len(obj))
+	for indexName, raw := range obj {
+		text, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: key for index %s must be JSON text, got %T", name, indexName, raw)
+		}
+		key, err := parseIndexKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		keys[indexName] = key
+	}
+	return keys, nil
+}
+
+// indexDefinitionsParam reads index definitions as index name -> list of
+// [field, direction] pairs, or index name -> {fields, unique, sparse,
+// multikey} with fields given as the same pairs. Pairs rather than an object
+// keep the field order, which an object would lose once decoded.
+func indexDefinitionsParam(params map[string]interface{}, name string) (map[string]IndexDefinition, error) {
+	raw := params[name]
+	if str, ok := raw.(string); ok {
+		if err := json.Unmarshal([]byte(str), &raw); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	switch defs := raw.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		definitions := make(map[string]IndexDefinition, len(defs))
+		for indexName, rawDef := range defs {
+			var definition IndexDefinition
+			rawFields := rawDef
+			if options, ok := rawDef.(map[string]interface{}); ok {
+				rawFields = options["fields"]
+				definition.Unique, _ = options["unique"].(bool)
+				definition.Sparse, _ = options["sparse"].(bool)
+				definition.Multikey, _ = options["multikey"].(bool)
+			}
+
+			fields, err := indexFields(rawFields)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: index %s %w", name, indexName, err)
+			}
+			definition.Fields = fields
+			definitions[indexName] = definition
+		}
+		return definitions, nil
+	default:
+		return nil, fmt.Errorf("invalid %s: expected an object, got %T", name, raw)
+	}
+}
+
+func indexFields(raw interface{}) ([]IndexField, error) {
+	pairs, ok := raw.([]interface{})
+	if !ok || len(pairs) == 0 {
+		return nil, fmt.Errorf("needs a non-empty array of fields")
+	}
+	fields := make([]IndexField, len(pairs))
+	for i, rawPair := range pairs {
+		pair, ok := rawPair.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("field %d is not a [field, direction] pair", i)
+		}
+		field, ok := pair[0].(string)
+		if !ok || field == "" {
+			return nil, fmt.Errorf("field %d has no name", i)
+		}
+		direction, err := fieldDirection(field, pair[1])
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = IndexField{Field: field, Direction: direction}
+	}
+	return fields, nil
+}
+
+// fieldDirection reads the direction of an index or sort field, which has to
+// be 1 or -1 whichever form the spec takes.
+func fieldDirection(field string, raw interface{}) (int, error) {
+	if number, ok := raw.(json.Number); ok {
+		raw, _ = number.Float64()
+	}
+	direction, ok := toNumber(raw)
+	if !ok || (direction != 1 && direction != -1) {
+		return 0, fmt.Errorf("field %s direction must be 1 or -1", field)
+	}
+	return int(direction), nil
+}
+
+func stringSlice(v interface{}) ([]string, error) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an array, got %T", v)
+	}
+	result := make([]string, len(arr))
+	for i, item := range arr {
+		str, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("element %d is not a string", i)
+		}
+		result[i] = str
+	}
+	return result, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxPathCacheSize = 1000
+
+var (
+	pathCache   = make(map[string][]string, 64)
+	pathCacheMu sync.RWMutex
+)
+
+func splitPath(path string) []string {
+	pathCacheMu.RLock()
+	segments, ok := pathCache[path]
+	pathCacheMu.RUnlock()
+	if ok {
+		return segments
+	}
+
+	segments = strings.Split(path, ".")
+
+	pathCacheMu.Lock()
+	if len(pathCache) >= maxPathCacheSize {
+		for k := range pathCache {
+			delete(pathCache, k)
+			break
+		}
+	}
+	pathCache[path] = segments
+	pathCacheMu.Unlock()
+	return segments
+}
+
+func arrayIndex(segment string, length int) (int, bool) {
+	if segment == "" || segment[0] < '0' || segment[0] > '9' {
+		return 0, false
+	}
+	index, err := strconv.Atoi(segment)
+	if err != nil || index >= length {
+		return 0, false
+	}
+	return index, true
+}
+
+// pathValues holds the values a path reached through an array of embedded
+// documents, one for each element that has the rest of the path. Matchers
+// test each value on its own, so {"items.tags": "x"} finds "x" in
+// {items: [{tags: ["x", "y"]}]} just as {tags: "x"} finds it in a top-level
+// array.
+type pathValues []interface{}
+
+// lookupPath resolves a dotted field path such as "address.city" or
+// "items.0.sku". When a segment that is not an array position meets an array,
+// the rest of the path is resolved against every element and the values found
+// are returned together as an array, the way MongoDB does it.
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	if strings.IndexByte(path, '.') < 0 {
+		value, ok := doc[path]
+		return value, ok
+	}
+	value, ok := lookupSegments(doc, splitPath(path))
+	if values, isValues := value.(pathValues); isValues {
+		return []interface{}(values), ok
+	}
+	return value, ok
+}
+
+// lookupSegments is lookupPath on split segments, except that the values
+// found through arrays come back as pathValues. A path through nested arrays
+// still gives a single flat list.
+func lookupSegments(current interface{}, segments []string) (interface{}, bool) {
+	for i, segment := range segments {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			if index, ok := arrayIndex(segment, len(node)); ok {
+				current = node[index]
+				continue
+			}
+			values := make(pathValues, 0, len(node))
+			for _, element := range node {
+				if _, isMap := element.(map[string]interface{}); !isMap {
+					continue
+				}
+				value, ok := lookupSegments(element, segments[i:])
+				if !ok {
+					continue
+				}
+				if nested, isValues := value.(pathValues); isValues {
+					values = append(values, nested...)
+				} else {
+					values = append(values, value)
+				}
+			}
+			if len(values) == 0 {
+				return nil, false
+			}
+			return values, true
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func getPathValue(doc map[string]interface{}, path string) interface{} {
+	value, _ := lookupPath(doc, path)
+	return value
+}
+
+// includePath copies the value at segments from src into dst, creating the
+// embedded documents along the way. Arrays of embedded documents are projected
+// element by element.
+func includePath(dst, src map[string]interface{}, segments []string) {
+	head := segments[0]
+	value, ok := src[head]
+	if !ok {
+		return
+	}
+	if len(segments) == 1 {
+		dst[head] = value
+		return
+	}
+
+	switch node := value.(type) {
+	case map[string]interface{}:
+		child, _ := dst[head].(map[string]interface{})
+		if child == nil {
+			child = make(map[string]interface{})
+		}
+		includePath(child, node, segments[1:])
+		dst[head] = child
+	case []interface{}:
+		existing, _ := dst[head].([]interface{})
+		projected := make([]interface{}, 0, len(node))
+		for _, element := range node {
+			elementMap, isMap := element.(map[string]interface{})
+			if !isMap {
+				continue
+			}
+			var child map[string]interface{}
+			if j := len(projected); j < len(existing) {
+				child, _ = existing[j].(map[string]interface{})
+			}
+			if child == nil {
+				child = make(map[string]interface{})
+			}
+			includePath(child, elementMap, segments[1:])
+			projected = append(projected, child)
+		}
+		dst[head] = projected
+	}
+}
+
+// excludePath returns a copy of doc without the value at segments. Only the
+// embedded documents on the path are copied; everything else is shared.
+func excludePath(doc map[string]interface{}, segments []string) map[string]interface{} {
+	head := segments[0]
+	value, ok := doc[head]
+	if !ok {
+		return doc
+	}
+
+	result := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		result[k] = v
+	}
+
+	if len(segments) == 1 {
+		delete(result, head)
+		return result
+	}
+
+	switch node := value.(type) {
+	case map[string]interface{}:
+		result[head] = excludePath(node, segments[1:])
+	case []interface{}:
+		elements := make([]interface{}, len(node))
+		for i, element := range node {
+			if elementMap, isMap := element.(map[string]interface{}); isMap {
+				elements[i] = excludePath(elementMap, segments[1:])
+			} else {
+				elements[i] = element
+			}
+		}
+		result[head] = elements
+	}
+	return result
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// Relative costs the planner weighs: reading one id out of an index, and
+// fetching and filtering one document.
+const (
+	idCost       = 1.0
+	documentCost = 4.0
+)
+
+// Range conditions cannot be sized without walking them, so they are assumed
+// to select a fixed share of the index, as most query planners do.
+const (
+	openRangeSelectivity   = 1.0 / 3
+	closedRangeSelectivity = 1.0 / 4
+)
+
+// QueryPlan describes how candidate ids were found.
+type QueryPlan struct {
+	Strategy       string   `json:"strategy"`
+	Indexes        []string `json:"indexes,omitempty"`
+	EstimatedCount int      `json:"estimatedCount"`
+	CandidateCount int      `json:"candidateCount"`
+}
+
+func scanPlan() QueryPlan {
+	return QueryPlan{Strategy: "scan"}
+}
+
+// accessPath is one way of answering part of a filter from the indexes,
+// together with an estimate of how many ids it would produce.
+type accessPath struct {
+	indexes  []string
+	estimate float64
+	union    bool
+	fetch    func() []string
+}
+
+// getCandidateIds returns the ids of the documents that can match filter, or
+// nil when a collection scan is expected to be cheaper than using the
+// indexes, along with the plan that was chosen.
+func (resolver *IndexResolver) getCandidateIds(filter map[string]interface{}) ([]string, QueryPlan) {
+	resolver.mutex.RLock()
+	defer resolver.mutex.RUnlock()
+
+	paths, estimate := resolver.planAnd(filter)
+	if paths == nil {
+		return nil, scanPlan()
+	}
+
+	ids := materializeAnd(paths)
+	if ids == nil {
+		return nil, scanPlan()
+	}
+
+	plan := QueryPlan{
+		Strategy:       "index",
+		EstimatedCount: int(math.Round(estimate)),
+		CandidateCount: len(ids),
+	}
+	switch {
+	case len(paths) > 1:
+		plan.Strategy = "intersection"
+	case paths[0].union:
+		plan.Strategy = "union"
+	}
+	for _, path := range paths {
+		plan.Indexes = append(plan.Indexes, path.indexes...)
+	}
+	return ids, plan
+}
+
+// documentCount estimates the size of the collection. Every index that is
+// not sparse holds each document at least once, so the largest such index is
+// the best lower bound available without the documents themselves.
+func (resolver *IndexResolver) documentCount() float64 {
+	count := 0
+	for _, metadata := range resolver.IndexMetadata {
+		metadata.mutex.RLock()
+		if !metadata.Sparse && metadata.Postings > count {
+			count = metadata.Postings
+		}
+		metadata.mutex.RUnlock()
+	}
+	return float64(count)
+}
+
+// planAnd picks the access paths to intersect for an implicit AND, cheapest
+// first. The cheapest path is used only if reading its ids and fetching the
+// documents they name beats scanning every document. Each further path is
+// added only while the documents it is expected to rule out are worth more
+// than the ids it costs to read. It returns nil paths when a scan is cheaper.
+func (resolver *IndexResolver) planAnd(filter map[string]interface{}) ([]accessPath, float64) {
+	paths := resolver.accessPaths(filter)
+	if len(paths) == 0 {
+		return nil, 0
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].estimate != paths[j].estimate {
+			return paths[i].estimate < paths[j].estimate
+		}
+		return strings.Join(paths[i].indexes, ",") < strings.Join(paths[j].indexes, ",")
+	})
+
+	total := resolver.documentCount()
+	best := paths[0]
+	if total > 0 && (idCost+documentCost)*best.estimate >= documentCost*total {
+		return nil, 0
+	}
+
+	chosen := []accessPath{best}
+	estimate := best.estimate
+	for _, path := range paths[1:] {
+		if estimate == 0 || total == 0 {
+			break
+		}
+		selectivity := math.Min(path.estimate/total, 1)
+		benefit := documentCost * estimate * (1 - selectivity)
+		if benefit <= idCost*path.estimate {
+			continue
+		}
+		chosen = append(chosen, path)
+		estimate *= selectivity
+	}
+	return chosen, estimate
+}
+
+func materializeAnd(paths []accessPath) []string {
+	var ids []string
+	for _, path := range paths {
+		pathIds := path.fetch()
+		if pathIds == nil {
+			continue
+		}
+		if ids == nil {
+			ids = pathIds
+		} else {
+			ids = intersectSlices(ids, pathIds)
+		}
+		if len(ids) == 0 {
+			break
+		}
+	}
+	return ids
+}
+
+// accessPaths lists every way the indexes can answer a condition of an
+// implicit AND, including the conditions of nested $and and $or. The caller
+// holds the resolver's read lock.
+func (resolver *IndexResolver) accessPaths(filter map[string]interface{}) []accessPath {
+	var paths []accessPath
+	usedIndexes := make(map[string]bool, len(filter))
+
+	for field, value := range filter {
+		switch field {
+		case "$and":
+			branches, _ := value.([]interface{})
+			for _, branch := range branches {
+				if branchFilter, ok := branch.(map[string]interface{}); ok {
+					paths = append(paths, resolver.accessPaths(branchFilter)...)
+				}
+			}
+			continue
+		case "$or":
+			if path, ok := resolver.unionPath(value); ok {
+				paths = append(paths, path)
+			}
+			continue
+		}
+		if len(field) > 0 && field[0] == '$' {
+			continue
+		}
+
+		for _, indexName := range resolver.FieldToIndex[field] {
+			if usedIndexes[indexName] {
+				continue
+			}
+			metadata := resolver.IndexMetadata[indexName]
+			if metadata == nil {
+				continue
+			}
+
+			estimate, ok := estimateCondition(metadata, filter, value)
+			if !ok {
+				continue
+			}
+			usedIndexes[indexName] = true
+
+			condition := value
+			paths = append(paths, accessPath{
+				indexes:  []string{indexName},
+				estimate: estimate,
+				fetch: func() []string {
+					if len(metadata.Fields) > 1 {
+						return getCompoundIds(metadata, filter)
+					}
+					if valueMap, ok := condition.(map[string]interface{}); ok {
+						return getFieldIdsFromOperators(metadata, valueMap)
+					}
+					return getFieldIdsFromValue(metadata, condition)
+				},
+			})
+		}
+	}
+	return paths
+}
+
+// unionPath answers an $or. Every branch has to be answerable and worth
+// answering from the indexes, since a branch left to a scan could match any
+// document.
+func (resolver *IndexResolver) unionPath(value interface{}) (accessPath, bool) {
+	branches, ok := value.([]interface{})
+	if !ok || len(branches) == 0 {
+		return accessPath{}, false
+	}
+
+	branchPaths := make([][]accessPath, 0, len(branches))
+	path := accessPath{union: true}
+	for _, branch := range branches {
+		branchFilter, ok := branch.(map[string]interface{})
+		if !ok {
+			return accessPath{}, false
+		}
+		chosen, estimate := resolver.planAnd(branchFilter)
+		if chosen == nil {
+			return accessPath{}, false
+		}
+		branchPaths = append(branchPaths, chosen)
+		path.estimate += estimate
+		for _, p := range chosen {
+			path.indexes = append(path.indexes, p.indexes...)
+		}
+	}
+
+	path.fetch = func() []string {
+		result := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, chosen := range branchPaths {
+			ids := materializeAnd(chosen)
+			if ids == nil {
+				return nil
+			}
+			for _, id := range ids {
+				if !seen[id] {
+					result = append(result, id)
+					seen[id] = true
+				}
+			}
+		}
+		return result
+	}
+	return path, true
+}
+
+// estimateCondition predicts how many ids an index lookup for value would
+// return, and whether the index can answer it at all. It follows the same
+// rules as the getFieldIds functions.
+func estimateCondition(index *IndexMetadata, filter map[string]interface{}, value interface{}) (float64, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	postings := float64(index.Postings)
+
+	if len(index.Fields) > 1 {
+		prefix, ranges, ok := compoundBounds(index, filter)
+		if !ok {
+			return 0, false
+		}
+		// Without per-field statistics, each fixed field is assumed to cut the
+		// index down by the same factor.
+		keys := math.Max(float64(index.Sorted.Len()), 1)
+		estimate := postings * math.Pow(keys, -float64(len(prefix))/float64(len(index.Fields)))
+		if len(ranges) > 0 {
+			estimate *= openRangeSelectivity
+		}
+		return estimate, true
+	}
+
+	countKey := func(v interface{}) (float64, bool) {
+		if v == nil {
+			return 0, false
+		}
+		if _, isArray := v.([]interface{}); isArray && index.Multikey {
+			return 0, false
+		}
+		count := 0
+		for _, operand := range operandValues(v) {
+			count += len(index.IndexMap[indexKey(operand)])
+		}
+		return float64(count), true
+	}
+
+	operators, isOperators := value.(map[string]interface{})
+	if !isOperators {
+		return countKey(value)
+	}
+
+	if eqVal, ok := operators["$eq"]; ok {
+		return countKey(eqVal)
+	}
+	if inArr, ok := operators["$in"].([]interface{}); ok {
+		total := 0.0
+		for _, v := range inArr {
+			count, ok := countKey(v)
+			if !ok {
+				return 0, false
+			}
+			total += count
+		}
+		return total, true
+	}
+
+	if allArr, ok := operators["$all"].([]interface{}); ok {
+		smallest := 0.0
+		for i, v := range allArr {
+			if _, isOperator := isOperatorObject(v); isOperator {
+				return 0, false
+			}
+			count, ok := countKey(v)
+			if !ok {
+				return 0, false
+			}
+			if i == 0 || count < smallest {
+				smallest = count
+			}
+		}
+		return smallest, true
+	}
+
+	if index.Sparse && hasNullBound(operators) {
+		return 0, false
+	}
+	_, hasLower := operators["$gt"]
+	if _, ok := operators["$gte"]; ok {
+		hasLower = true
+	}
+	_, hasUpper := operators["$lt"]
+	if _, ok := operators["$lte"]; ok {
+		hasUpper = true
+	}
+	switch {
+	case hasLower && hasUpper:
+		if index.Multikey {
+			return 0, false
+		}
+		return postings * closedRangeSelectivity, true
+	case hasLower || hasUpper:
+		return postings * openRangeSelectivity, true
+	}
+
+	if ninArr, ok := operators["$nin"].([]interface{}); ok && !index.Sparse {
+		excluded := 0.0
+		for _, v := range ninArr {
+			for _, operand := range operandValues(v) {
+				excluded += float64(len(index.IndexMap[indexKey(operand)]))
+			}
+		}
+		return math.Max(postings-excluded, 0), true
+	}
+
+	return 0, false
+}
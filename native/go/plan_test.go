@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// planTestResolver indexes 1000 documents: email is unique, status has 900
+// "active" and 100 "archived", and age takes 100 values ten times each.
+func planTestResolver(t *testing.T) *IndexResolver {
+	t.Helper()
+	keys := map[string]map[string][]string{"email": {}, "status": {}, "age": {}}
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		status := `"active"`
+		if i%10 == 0 {
+			status = `"archived"`
+		}
+		keys["email"][fmt.Sprintf(`"user%d@example.com"`, i)] = []string{id}
+		keys["status"][status] = append(keys["status"][status], id)
+		age := fmt.Sprint(i % 100)
+		keys["age"][age] = append(keys["age"][age], id)
+	}
+
+	resolver := newIndexResolver()
+	if err := resolver.rebuildIndexMapping(keys, nil); err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+func TestPlannerChoosesIndexes(t *testing.T) {
+	resolver := planTestResolver(t)
+	teens := map[string]interface{}{"$gte": float64(10), "$lt": float64(20)}
+
+	tests := []struct {
+		name     string
+		filter   map[string]interface{}
+		strategy string
+		indexes  []string
+	}{
+		{"unique key", map[string]interface{}{"email": "user5@example.com"}, "index", []string{"email"}},
+		{"rare status", map[string]interface{}{"status": "archived"}, "index", []string{"status"}},
+		{"common status scans", map[string]interface{}{"status": "active"}, "scan", nil},
+		{"unindexed field scans", map[string]interface{}{"name": "x"}, "scan", nil},
+		{"closed range", map[string]interface{}{"age": teens}, "index", []string{"age"}},
+		{"common status next to a unique key", map[string]interface{}{"email": "user5@example.com", "status": "active"}, "index", []string{"email"}},
+		{"common status next to a range", map[string]interface{}{"age": teens, "status": "active"}, "index", []string{"age"}},
+		{"rare status intersected with a range", map[string]interface{}{"age": teens, "status": "archived"}, "intersection", []string{"status", "age"}},
+		{"unique key not intersected", map[string]interface{}{"email": "user5@example.com", "status": "archived"}, "index", []string{"email"}},
+		{"$or of keys", map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"email": "user1@example.com"},
+			map[string]interface{}{"email": "user2@example.com"},
+		}}, "union", []string{"email", "email"}},
+		{"$or with an unindexed branch scans", map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"email": "user1@example.com"},
+			map[string]interface{}{"name": "x"},
+		}}, "scan", nil},
+	}
+	for _, tt := range tests {
+		ids, plan := resolver.getCandidateIds(tt.filter)
+		if plan.Strategy != tt.strategy || !reflect.DeepEqual(plan.Indexes, tt.indexes) {
+			t.Errorf("%s: planned %s with %v, want %s with %v", tt.name, plan.Strategy, plan.Indexes, tt.strategy, tt.indexes)
+		}
+		if tt.strategy == "scan" && ids != nil {
+			t.Errorf("%s: a scan returned %d candidates", tt.name, len(ids))
+		}
+	}
+
+	ids, plan := resolver.getCandidateIds(map[string]interface{}{"age": teens, "status": "archived"})
+	if len(ids) != 10 || plan.CandidateCount != 10 {
+		t.Errorf("intersection: %d candidates, plan says %d; want the 10 archived teens", len(ids), plan.CandidateCount)
+	}
+}
@@ -1,38 +1,20 @@
 package main
 
-import (
-	"encoding/json"
-)
-
-func parseProjection(projectionJSON string) (map[string]int, error) {
-	var projection map[string]interface{}
-	if err := json.Unmarshal([]byte(projectionJSON), &projection); err != nil {
-		return nil, err
-	}
-
+func parseProjection(projection map[string]interface{}) map[string]int {
 	result := make(map[string]int, len(projection))
 	for field, value := range projection {
 		if valNum, ok := value.(float64); ok {
 			result[field] = int(valNum)
 		}
 	}
-	return result, nil
+	return result
 }
 
-func ProjectDocuments(documentsJSON string, projectionJSON string) string {
-	var documents []map[string]interface{}
-	if err := json.Unmarshal([]byte(documentsJSON), &documents); err != nil {
-		return `{"error":"` + err.Error() + `"}`
-	}
-
-	projection, err := parseProjection(projectionJSON)
-	if err != nil {
-		return `{"error":"` + err.Error() + `"}`
-	}
+func projectDocuments(documents []map[string]interface{}, projectionMap map[string]interface{}) []map[string]interface{} {
+	projection := parseProjection(projectionMap)
 
 	if len(documents) == 0 || len(projection) == 0 {
-		result, _ := json.Marshal(map[string]interface{}{"results": documents})
-		return string(result)
+		return documents
 	}
 
 	includeFields := make([]string, 0, len(projection))
@@ -47,32 +29,27 @@ func ProjectDocuments(documentsJSON string, projectionJSON string) string {
 
 	projected := make([]map[string]interface{}, len(documents))
 	for i, doc := range documents {
-		projDoc := make(map[string]interface{})
-
 		if len(includeFields) > 0 {
+			projDoc := make(map[string]interface{}, len(includeFields))
 			for _, field := range includeFields {
-				if val, ok := doc[field]; ok {
-					projDoc[field] = val
-				}
+				includePath(projDoc, doc, splitPath(field))
 			}
-		} else {
+			projected[i] = projDoc
+			continue
+		}
+
+		projDoc := doc
+		for _, field := range excludeFields {
+			projDoc = excludePath(projDoc, splitPath(field))
+		}
+		if len(excludeFields) == 0 {
+			projDoc = make(map[string]interface{}, len(doc))
 			for field, val := range doc {
-				excluded := false
-				for _, exField := range excludeFields {
-					if field == exField {
-						excluded = true
-						break
-					}
-				}
-				if !excluded {
-					projDoc[field] = val
-				}
+				projDoc[field] = val
 			}
 		}
-
 		projected[i] = projDoc
 	}
 
-	result, _ := json.Marshal(map[string]interface{}{"results": projected})
-	return string(result)
+	return projected
 }
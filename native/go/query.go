@@ -0,0 +1,138 @@
+package main
+
+import "time"
+
+type QuerySpec struct {
+	Filter     map[string]interface{}
+	Sort       []SortField
+	Skip       int
+	Limit      int
+	Projection map[string]interface{}
+	Explain    bool
+}
+
+type QueryResult struct {
+	Documents []map[string]interface{} `json:"documents"`
+	Total     int                      `json:"total"`
+	HasMore   bool                     `json:"hasMore"`
+	Explain   *QueryExplain            `json:"explain,omitempty"`
+}
+
+// QueryExplain reports how a query or filter call ran. Candidates is the
+// number of documents left after the index lookup, which is every document
+// when the plan is a scan.
+type QueryExplain struct {
+	Plan              QueryPlan    `json:"plan"`
+	Candidates        int          `json:"candidates"`
+	DocumentsExamined int          `json:"documentsExamined"`
+	Matched           int          `json:"matched"`
+	Returned          int          `json:"returned"`
+	Workers           int          `json:"workers"`
+	Parallel          bool         `json:"parallel"`
+	SortStrategy      string       `json:"sortStrategy,omitempty"`
+	Timings           PhaseTimings `json:"timings"`
+}
+
+// PhaseTimings holds the time spent in each phase, in milliseconds.
+type PhaseTimings struct {
+	Index   float64 `json:"index"`
+	Filter  float64 `json:"filter"`
+	Sort    float64 `json:"sort"`
+	Project float64 `json:"project"`
+	Total   float64 `json:"total"`
+}
+
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// runQuery filters, sorts, pages and projects in one pass. A limit of zero
+// means no limit, matching QueryOptions on the TypeScript side.
+// When spec.Explain is set, the result's Explain holds the filter statistics
+// and the timings of the phases run here; the caller fills in the plan.
+func runQuery(documents []map[string]interface{}, spec QuerySpec) (QueryResult, error) {
+	var timings PhaseTimings
+	phase := time.Now()
+
+	matches, stats, err := filterDocumentsWithStats(documents, spec.Filter, len(documents))
+	if err != nil {
+		return QueryResult{}, err
+	}
+	total := len(matches)
+	timings.Filter = millisSince(phase)
+
+	phase = time.Now()
+	start := min(max(spec.Skip, 0), len(matches))
+	page, sortStrategy := sortWindow(matches, spec.Sort, start, spec.Limit)
+	timings.Sort = millisSince(phase)
+
+	phase = time.Now()
+	if len(spec.Projection) > 0 {
+		page = projectDocuments(page, spec.Projection)
+	}
+	timings.Project = millisSince(phase)
+
+	result := QueryResult{
+		Documents: page,
+		Total:     total,
+		HasMore:   total > start+len(page),
+	}
+	if spec.Explain {
+		result.Explain = &QueryExplain{
+			Plan:              scanPlan(),
+			Candidates:        len(documents),
+			DocumentsExamined: stats.Examined,
+			Matched:           total,
+			Returned:          len(page),
+			Workers:           stats.Workers,
+			Parallel:          stats.Parallel,
+			SortStrategy:      sortStrategy,
+			Timings:           timings,
+		}
+	}
+	return result, nil
+}
+
+// queryCandidates narrows the documents to those the indexes say can match,
+// and returns the plan used to find them. Resident collections are looked up
+// by id; inline documents are filtered by their _id. Either way the result
+// keeps document order.
+func queryCandidates(params map[string]interface{}, filter map[string]interface{}) ([]map[string]interface{}, QueryPlan, error) {
+	var ids []string
+	plan := scanPlan()
+	if len(filter) > 0 {
+		if database, collection, err := scopeParam(params); err == nil {
+			if resolver := getResolver(database, collection); resolver != nil {
+				ids, plan = resolver.getCandidateIds(filter)
+			}
+		}
+	}
+
+	store, err := residentParam(params)
+	if err != nil {
+		return nil, plan, err
+	}
+	if store != nil {
+		if ids != nil {
+			return store.Select(ids), plan, nil
+		}
+		return store.Snapshot(), plan, nil
+	}
+
+	documents, err := documentsParam(params, "documents")
+	if err != nil || ids == nil {
+		return documents, plan, err
+	}
+
+	idSet := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		idSet[id] = true
+	}
+	candidates := make([]map[string]interface{}, 0, len(ids))
+	for _, doc := range documents {
+		if id, ok := documentID(doc); ok && idSet[id] {
+			candidates = append(candidates, doc)
+		}
+	}
+	return candidates, plan, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type DocumentStore struct {
+	Name      string
+	Documents []map[string]interface{}
+	positions map[string]int
+	mutex     sync.RWMutex
+}
+
+var (
+	collections   = make(map[string]*DocumentStore)
+	collectionsMu sync.RWMutex
+)
+
+func newDocumentStore(name string) *DocumentStore {
+	return &DocumentStore{
+		Name:      name,
+		Documents: make([]map[string]interface{}, 0),
+		positions: make(map[string]int),
+	}
+}
+
+func documentID(doc map[string]interface{}) (string, bool) {
+	id, ok := doc["_id"]
+	if !ok || id == nil {
+		return "", false
+	}
+	return valueToString(id), true
+}
+
+func getCollection(database, name string) *DocumentStore {
+	collectionsMu.RLock()
+	defer collectionsMu.RUnlock()
+	return collections[collectionKey(database, name)]
+}
+
+func getOrCreateCollection(database, name string) *DocumentStore {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+
+	key := collectionKey(database, name)
+	store := collections[key]
+	if store == nil {
+		store = newDocumentStore(name)
+		collections[key] = store
+	}
+	return store
+}
+
+// Snapshot returns the documents in insertion order. The slice is a copy, so
+// callers may reorder it; the documents themselves are never mutated in place.
+func (s *DocumentStore) Snapshot() []map[string]interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snapshot := make([]map[string]interface{}, len(s.Documents))
+	copy(snapshot, s.Documents)
+	return snapshot
+}
+
+func (s *DocumentStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.Documents)
+}
+
+// Select returns the documents with the given ids in insertion order.
+func (s *DocumentStore) Select(ids []string) []map[string]interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	positions := make([]int, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if pos, ok := s.positions[id]; ok && !seen[pos] {
+			positions = append(positions, pos)
+			seen[pos] = true
+		}
+	}
+	sort.Ints(positions)
+
+	selected := make([]map[string]interface{}, len(positions))
+	for i, pos := range positions {
+		selected[i] = s.Documents[pos]
+	}
+	return selected
+}
+
+func (s *DocumentStore) Replace(documents []map[string]interface{}) error {
+	positions := make(map[string]int, len(documents))
+	for i, doc := range documents {
+		id, ok := documentID(doc)
+		if !ok {
+			return fmt.Errorf("document at position %d has no _id", i)
+		}
+		if _, duplicate := positions[id]; duplicate {
+			return fmt.Errorf("duplicate _id %s at position %d", id, i)
+		}
+		positions[id] = i
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Documents = documents
+	s.positions = positions
+	return nil
+}
+
+func (s *DocumentStore) Upsert(documents []map[string]interface{}) (inserted int, modified int, err error) {
+	for i, doc := range documents {
+		if _, ok := documentID(doc); !ok {
+			return 0, 0, fmt.Errorf("document at position %d has no _id", i)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, doc := range documents {
+		id, _ := documentID(doc)
+		if pos, exists := s.positions[id]; exists {
+			s.Documents[pos] = doc
+			modified++
+			continue
+		}
+		s.positions[id] = len(s.Documents)
+		s.Documents = append(s.Documents, doc)
+		inserted++
+	}
+	return inserted, modified, nil
+}
+
+func (s *DocumentStore) Remove(ids []string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if _, exists := s.positions[id]; exists {
+			removed[id] = true
+		}
+	}
+	if len(removed) == 0 {
+		return 0
+	}
+
+	// Compact in one pass so the remaining documents keep their order.
+	kept := s.Documents[:0]
+	for _, doc := range s.Documents {
+		id, _ := documentID(doc)
+		if removed[id] {
+			delete(s.positions, id)
+			continue
+		}
+		s.positions[id] = len(kept)
+		kept = append(kept, doc)
+	}
+	for i := len(kept); i < len(s.Documents); i++ {
+		s.Documents[i] = nil
+	}
+	s.Documents = kept
+	return len(removed)
+}
+
+func errCollectionNotLoaded(name string) error {
+	return fmt.Errorf("collection not loaded: %s", name)
+}
+
+func loadCollection(database, name string, documents []map[string]interface{}) (int, error) {
+	store := newDocumentStore(name)
+	if err := store.Replace(documents); err != nil {
+		return 0, err
+	}
+
+	collectionsMu.Lock()
+	collections[collectionKey(database, name)] = store
+	collectionsMu.Unlock()
+	return len(documents), nil
+}
+
+func dropCollection(database, name string) bool {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+
+	key := collectionKey(database, name)
+	if _, exists := collections[key]; !exists {
+		return false
+	}
+	delete(collections, key)
+	return true
+}
+
+// residentParam returns the resident collection named by "collection" and
+// "database" when the call has no inline "documents". It returns nil when the
+// call has documents of its own or names no collection.
+func residentParam(params map[string]interface{}) (*DocumentStore, error) {
+	if _, inline := params["documents"]; inline {
+		return nil, nil
+	}
+	if _, named := params["collection"]; !named {
+		return nil, nil
+	}
+	database, name, err := scopeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	store := getCollection(database, name)
+	if store == nil {
+		return nil, errCollectionNotLoaded(name)
+	}
+	return store, nil
+}
+
+// documentsSource resolves the documents a query runs against: a resident
+// collection when "collection" is given, otherwise the inline "documents".
+func documentsSource(params map[string]interface{}) ([]map[string]interface{}, error) {
+	store, err := residentParam(params)
+	if err != nil {
+		return nil, err
+	}
+	if store != nil {
+		return store.Snapshot(), nil
+	}
+	return documentsParam(params, "documents")
+}
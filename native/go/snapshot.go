@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Index snapshots let the sidecar reload a collection's indexes from disk
+// instead of receiving every posting list through rebuildIndexMapping. Each
+// collection has one file under the database directory:
+//
+//	magic     8 bytes  "NUBOIDX\x00"
+//	version   uint16
+//	marker    uint64 document count, int64 last-modified unix nanoseconds
+//	          (0 for a collection without documents)
+//	indexes   uvarint count, then per index:
+//	            name, uvarint field count, per field name and int8 direction,
+//	            flags byte (unique, sparse, multikey),
+//	            uvarint key count, per key its JSON text, uvarint id count, ids
+//	checksum  uint32 CRC-32C of everything before it
+//
+// Integers are big-endian and strings are a uvarint length followed by bytes.
+const (
+	snapshotMagic     = "NUBOIDX\x00"
+	snapshotVersion   = 2
+	snapshotDir       = ".indexes"
+	snapshotExtension = ".idx"
+	documentExtension = ".bson"
+)
+
+const (
+	snapshotFlagUnique = 1 << iota
+	snapshotFlagSparse
+	snapshotFlagMultikey
+)
+
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// collectionMarker identifies a state of a collection's files on disk. The
+// document count catches deletions and the newest modification time catches
+// inserts and overwrites.
+type collectionMarker struct {
+	Documents    int
+	LastModified time.Time
+}
+
+func (m collectionMarker) equal(other collectionMarker) bool {
+	return m.Documents == other.Documents && m.LastModified.Equal(other.LastModified)
+}
+
+func (m collectionMarker) toMap() map[string]interface{} {
+	var lastModified interface{}
+	if !m.LastModified.IsZero() {
+		lastModified = m.LastModified.UTC().Format(time.RFC3339Nano)
+	}
+	return map[string]interface{}{
+		"documents":    m.Documents,
+		"lastModified": lastModified,
+	}
+}
+
+// readCollectionMarker stats the document files of a collection, which live
+// in a folder named after it in the database directory.
+func readCollectionMarker(database, collection string) (collectionMarker, error) {
+	var marker collectionMarker
+	if err := checkCollectionName(collection); err != nil {
+		return marker, err
+	}
+	entries, err := os.ReadDir(filepath.Join(database, collection))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return marker, nil
+		}
+		return marker, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), documentExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// The file went away between listing and stat.
+			continue
+		}
+		marker.Documents++
+		if info.ModTime().After(marker.LastModified) {
+			marker.LastModified = info.ModTime()
+		}
+	}
+	return marker, nil
+}
+
+func snapshotPath(database, collection string) (string, error) {
+	if err := checkCollectionName(collection); err != nil {
+		return "", err
+	}
+	return filepath.Join(database, snapshotDir, collection+snapshotExtension), nil
+}
+
+// checkCollectionName rejects names that would reach outside the database
+// directory once joined to it, or name the database directory itself.
+func checkCollectionName(collection string) error {
+	if strings.ContainsAny(collection, "/\\\x00") || strings.Contains(collection, "..") || filepath.Clean(collection) == "." {
+		return fmt.Errorf("invalid collection name: %q", collection)
+	}
+	return nil
+}
+
+type snapshotWriter struct {
+	buf     *bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.scratch[:], v)
+	w.buf.Write(w.scratch[:n])
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// encodeSnapshot serializes the resolver's indexes in name and key order, so
+// the same indexes always produce the same bytes.
+func (resolver *IndexResolver) encodeSnapshot(marker collectionMarker) ([]byte, []string) {
+	resolver.mutex.RLock()
+	defer resolver.mutex.RUnlock()
+
+	w := &snapshotWriter{buf: &bytes.Buffer{}}
+	w.buf.WriteString(snapshotMagic)
+	binary.Write(w.buf, binary.BigEndian, uint16(snapshotVersion))
+	binary.Write(w.buf, binary.BigEndian, uint64(marker.Documents))
+	var modified int64
+	if !marker.LastModified.IsZero() {
+		modified = marker.LastModified.UnixNano()
+	}
+	binary.Write(w.buf, binary.BigEndian, modified)
+
+	names := sortedKeys(resolver.IndexMetadata)
+	w.uvarint(uint64(len(names)))
+	for _, name := range names {
+		index := resolver.IndexMetadata[name]
+		index.mutex.RLock()
+
+		w.string(name)
+		w.uvarint(uint64(len(index.Fields)))
+		for i, field := range index.Fields {
+			w.string(field)
+			w.buf.WriteByte(byte(int8(index.Directions[i])))
+		}
+
+		var flags byte
+		if index.Unique {
+			flags |= snapshotFlagUnique
+		}
+		if index.Sparse {
+			flags |= snapshotFlagSparse
+		}
+		if index.Multikey {
+			flags |= snapshotFlagMultikey
+		}
+		w.buf.WriteByte(flags)
+
+		w.uvarint(uint64(len(index.IndexMap)))
+		for _, key := range sortedKeys(index.IndexMap) {
+			ids := index.IndexMap[key]
+			w.string(key)
+			w.uvarint(uint64(len(ids)))
+			for _, id := range ids {
+				w.string(id)
+			}
+		}
+
+		index.mutex.RUnlock()
+	}
+
+	binary.Write(w.buf, binary.BigEndian, crc32.Checksum(w.buf.Bytes(), snapshotTable))
+	return w.buf.Bytes(), names
+}
+
+// saveIndexSnapshot writes the collection's indexes next to its documents.
+// The file is written under a temporary name and renamed into place, so a
+// reader never sees half of it.
+func saveIndexSnapshot(database, collection string, resolver *IndexResolver) (map[string]interface{}, error) {
+	marker, err := readCollectionMarker(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	path, err := snapshotPath(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	data, names := resolver.encodeSnapshot(marker)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"path":    path,
+		"indexes": names,
+		"bytes":   len(data),
+		"marker":  marker.toMap(),
+	}, nil
+}
+
+type snapshotReader struct {
+	r *bytes.Reader
+}
+
+func (r snapshotReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(r.r)
+}
+
+func (r snapshotReader) string() (string, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// capacity bounds a count read from the file by the bytes left, so a bad
+// count cannot make the reader allocate more than the file could hold.
+func (r snapshotReader) capacity(count uint64) int {
+	if remaining := uint64(r.r.Len()); count > remaining {
+		return int(remaining)
+	}
+	return int(count)
+}
+
+// decodeSnapshot checks a snapshot's magic, version and checksum, then builds
+// the indexes it holds.
+func decodeSnapshot(data []byte) (map[string]*IndexMetadata, collectionMarker, error) {
+	var marker collectionMarker
+	headerSize := len(snapshotMagic) + 2 + 8 + 8
+	if len(data) < headerSize+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, marker, fmt.Errorf("not an index snapshot")
+	}
+
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, snapshotTable) != binary.BigEndian.Uint32(trailer) {
+		return nil, marker, fmt.Errorf("index snapshot checksum mismatch")
+	}
+
+	header := body[len(snapshotMagic):headerSize]
+	if version := binary.BigEndian.Uint16(header); version != snapshotVersion {
+		return nil, marker, fmt.Errorf("unsupported index snapshot version %d", version)
+	}
+	marker.Documents = int(binary.BigEndian.Uint64(header[2:]))
+	if modified := int64(binary.BigEndian.Uint64(header[10:])); modified != 0 {
+		marker.LastModified = time.Unix(0, modified)
+	}
+
+	r := snapshotReader{r: bytes.NewReader(body[headerSize:])}
+	built, err := r.indexes()
+	if err != nil {
+		return nil, marker, fmt.Errorf("corrupt index snapshot: %w", err)
+	}
+	return built, marker, nil
+}
+
+func (r snapshotReader) indexes() (map[string]*IndexMetadata, error) {
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	built := make(map[string]*IndexMetadata, r.capacity(count))
+	for i := uint64(0); i < count; i++ {
+		name, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+
+		fieldCount, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if fieldCount == 0 {
+			return nil, fmt.Errorf("index %s has no fields", name)
+		}
+		var definition IndexDefinition
+		for j := uint64(0); j < fieldCount; j++ {
+			field, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			direction, err := r.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			definition.Fields = append(definition.Fields, IndexField{Field: field, Direction: int(int8(direction))})
+		}
+
+		flags, err := r.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		definition.Unique = flags&snapshotFlagUnique != 0
+		definition.Sparse = flags&snapshotFlagSparse != 0
+		definition.Multikey = flags&snapshotFlagMultikey != 0
+
+		keyCount, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string][]string, r.capacity(keyCount))
+		for j := uint64(0); j < keyCount; j++ {
+			key, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			idCount, err := r.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			ids := make([]string, 0, r.capacity(idCount))
+			for k := uint64(0); k < idCount; k++ {
+				id, err := r.string()
+				if err != nil {
+					return nil, err
+				}
+				ids = append(ids, id)
+			}
+			entries[key] = ids
+		}
+
+		metadata := newIndexMetadata(name, definition)
+		if err := metadata.fill(entries); err != nil {
+			return nil, err
+		}
+		built[name] = metadata
+	}
+
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after %d indexes", count)
+	}
+	return built, nil
+}
+
+// loadIndexSnapshot replaces the collection's indexes with the ones in its
+// snapshot file. A snapshot is stale when the collection's documents have
+// changed since it was written. Its indexes would be missing those changes,
+// so a stale snapshot is only loaded when allowStale is set; otherwise the
+// current indexes are kept and the caller can rebuild.
+func loadIndexSnapshot(database, collection string, allowStale bool) (map[string]interface{}, error) {
+	path, err := snapshotPath(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return map[string]interface{}{"loaded": false, "path": path}, nil
+		}
+		return nil, err
+	}
+
+	built, marker, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	current, err := readCollectionMarker(database, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := !marker.equal(current)
+	loaded := !stale || allowStale
+	if loaded {
+		getOrCreateResolver(database, collection).replaceIndexes(built)
+	}
+
+	return map[string]interface{}{
+		"loaded":  loaded,
+		"path":    path,
+		"indexes": sortedKeys(built),
+		"stale":   stale,
+		"marker":  marker.toMap(),
+		"current": current.toMap(),
+	}, nil
+}
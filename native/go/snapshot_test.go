@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadStaleSnapshot(t *testing.T) {
+	database := t.TempDir()
+	collection := "users"
+	if err := os.MkdirAll(filepath.Join(database, collection), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := getOrCreateResolver(database, collection)
+	defer dropResolver(database, collection)
+	if err := resolver.rebuildIndexMapping(map[string]map[string][]string{"status": {`"active"`: {"d1"}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveIndexSnapshot(database, collection, resolver); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write after the snapshot makes it stale; the live indexes have it.
+	if err := os.WriteFile(filepath.Join(database, collection, "d2.bson"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolver.indexInsert("d2", map[string]string{"status": `"active"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := loadIndexSnapshot(database, collection, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["loaded"] != false || result["stale"] != true {
+		t.Errorf("got loaded %v, stale %v; want a stale snapshot left unloaded", result["loaded"], result["stale"])
+	}
+	if got := getResolver(database, collection).IndexMetadata["status"].Postings; got != 2 {
+		t.Errorf("live index has %d postings after refusing the snapshot, want 2", got)
+	}
+
+	result, err = loadIndexSnapshot(database, collection, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["loaded"] != true {
+		t.Error("allowStale did not load the snapshot")
+	}
+	if got := getResolver(database, collection).IndexMetadata["status"].Postings; got != 1 {
+		t.Errorf("snapshot index has %d postings, want 1", got)
+	}
+}
+
+func TestSnapshotRejectsCollectionPaths(t *testing.T) {
+	database := t.TempDir()
+	for _, collection := range []string{"../users", "a/b", `a\b`, "..", ".", ""} {
+		if _, err := saveIndexSnapshot(database, collection, newIndexResolver()); err == nil {
+			t.Errorf("save accepted collection %q", collection)
+		}
+		if _, err := loadIndexSnapshot(database, collection, false); err == nil {
+			t.Errorf("load accepted collection %q", collection)
+		}
+	}
+}
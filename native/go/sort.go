@@ -1,7 +1,9 @@
 package main
 
 import (
+	"container/heap"
 	"encoding/json"
+	"fmt"
 	"sort"
 	"strings"
 	"time"
@@ -12,112 +14,93 @@ type SortField struct {
 	Direction int
 }
 
-func parseSort(sortJSON string) ([]SortField, error) {
-	var sortMap map[string]interface{}
-	if err := json.Unmarshal([]byte(sortJSON), &sortMap); err != nil {
-		return nil, err
-	}
-
-	fields := make([]SortField, 0, len(sortMap))
-	for field, dir := range sortMap {
-		direction := 1
-		if dirNum, ok := dir.(float64); ok {
-			if dirNum < 0 {
-				direction = -1
+// parseSort reads a sort spec with its fields in order of precedence. The
+// spec is a list of [field, direction] pairs, or an object. An object keeps
+// its key order only while it is JSON text; once decoded into a map the order
+// is gone, so a decoded object may name a single field. Directions are 1 or
+// -1 in either form.
+func parseSort(raw interface{}) ([]SortField, error) {
+	switch spec := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if strings.TrimSpace(spec) == "" {
+			return nil, nil
+		}
+		return parseSortJSON(spec)
+	case []interface{}:
+		if len(spec) == 0 {
+			return nil, nil
+		}
+		indexed, err := indexFields(spec)
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]SortField, len(indexed))
+		for i, field := range indexed {
+			fields[i] = SortField{Field: field.Field, Direction: field.Direction}
+		}
+		return fields, nil
+	case map[string]interface{}:
+		if len(spec) > 1 {
+			return nil, fmt.Errorf("an object with %d fields has no field order once decoded; send [field, direction] pairs", len(spec))
+		}
+		fields := make([]SortField, 0, 1)
+		for field, dir := range spec {
+			direction, err := fieldDirection(field, dir)
+			if err != nil {
+				return nil, err
 			}
+			fields = append(fields, SortField{Field: field, Direction: direction})
 		}
-		fields = append(fields, SortField{
-			Field:     field,
-			Direction: direction,
-		})
+		return fields, nil
+	default:
+		return nil, fmt.Errorf("expected an object or an array of [field, direction] pairs, got %T", raw)
 	}
-	return fields, nil
 }
 
-func compareValues(a, b interface{}, direction int) int {
-	if a == nil && b == nil {
-		return 0
-	}
-	if a == nil {
-		return -1 * direction
-	}
-	if b == nil {
-		return 1 * direction
+// parseSortJSON decodes a sort spec from JSON text, reading an object's keys
+// one by one so they keep the order they were written in.
+func parseSortJSON(text string) ([]SortField, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
 	}
 
-	aType := getType(a)
-	bType := getType(b)
-
-	if aType != bType {
-		return 0
+	switch token {
+	case json.Delim('['):
+		var pairs []interface{}
+		if err := json.Unmarshal([]byte(text), &pairs); err != nil {
+			return nil, err
+		}
+		return parseSort(pairs)
+	case json.Delim('{'):
+	default:
+		return nil, fmt.Errorf("expected an object or an array, got %v", token)
 	}
 
-	switch aType {
-	case "string":
-		strA := a.(string)
-		strB := b.(string)
-		result := strings.Compare(strA, strB)
-		if result != 0 {
-			return result * direction
+	fields := make([]SortField, 0)
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
 		}
-		return 0
-	case "number":
-		numA, _ := toNumber(a)
-		numB, _ := toNumber(b)
-		diff := numA - numB
-		if diff != 0 {
-			if diff < 0 {
-				return -1 * direction
-			}
-			return 1 * direction
-		}
-		return 0
-	case "date":
-		timeA, okA := parseTime(a)
-		timeB, okB := parseTime(b)
-		if okA && okB {
-			diff := timeA.Sub(timeB)
-			if diff != 0 {
-				if diff < 0 {
-					return -1 * direction
-				}
-				return 1 * direction
-			}
-			return 0
+		var dir interface{}
+		if err := decoder.Decode(&dir); err != nil {
+			return nil, err
 		}
-		return 0
-	case "boolean":
-		boolA := a.(bool)
-		boolB := b.(bool)
-		if boolA == boolB {
-			return 0
+		direction, err := fieldDirection(key.(string), dir)
+		if err != nil {
+			return nil, err
 		}
-		if boolA {
-			return 1 * direction
-		}
-		return -1 * direction
-	default:
-		return 0
-	}
-}
-
-func getType(v interface{}) string {
-	switch v.(type) {
-	case string:
-		return "string"
-	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
-		return "number"
-	case bool:
-		return "boolean"
-	case time.Time:
-		return "date"
+		fields = append(fields, SortField{Field: key.(string), Direction: direction})
 	}
-	if str, ok := v.(string); ok {
-		if _, err := time.Parse(time.RFC3339, str); err == nil {
-			return "date"
-		}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
 	}
-	return "unknown"
+	return fields, nil
 }
 
 func parseTime(v interface{}) (time.Time, bool) {
@@ -135,41 +118,143 @@ func parseTime(v interface{}) (time.Time, bool) {
 	return time.Time{}, false
 }
 
-func getFieldValue(doc map[string]interface{}, field string) interface{} {
-	if val, ok := doc[field]; ok {
-		return val
-	}
-	return nil
-}
-
-func SortDocuments(documentsJSON string, sortJSON string) string {
-	var documents []map[string]interface{}
-	if err := json.Unmarshal([]byte(documentsJSON), &documents); err != nil {
-		return `{"error":"` + err.Error() + `"}`
-	}
+// Sort strategies reported by sortWindow and externalSort.
+const (
+	sortStrategyNone     = "none"
+	sortStrategyFull     = "full"
+	sortStrategyTopK     = "topK"
+	sortStrategyExternal = "external"
+)
 
-	sortFields, err := parseSort(sortJSON)
-	if err != nil {
-		return `{"error":"` + err.Error() + `"}`
-	}
+// A bounded heap is used when the documents wanted, skip+limit, are at most
+// this fraction of the input; closer to n a full sort is just as fast.
+const topKMaxFraction = 4
 
-	if len(documents) <= 1 || len(sortFields) == 0 {
-		result, _ := json.Marshal(map[string]interface{}{"results": documents})
-		return string(result)
+// documentLess orders documents by the sort fields, in turn, and then by
+// _id, so that documents with equal sort keys still come out in the same
+// order on every call and pages of a sorted result never overlap. Documents
+// without an _id keep their input order, which the stable sorts below
+// preserve.
+func documentLess(sortFields []SortField) func(a, b map[string]interface{}) bool {
+	byID := true
+	for _, sortField := range sortFields {
+		if sortField.Field == "_id" {
+			byID = false
+		}
 	}
 
-	sort.Slice(documents, func(i, j int) bool {
+	return func(a, b map[string]interface{}) bool {
 		for _, sortField := range sortFields {
-			valI := getFieldValue(documents[i], sortField.Field)
-			valJ := getFieldValue(documents[j], sortField.Field)
-			comparison := compareValues(valI, valJ, sortField.Direction)
+			comparison := compareValues(getPathValue(a, sortField.Field), getPathValue(b, sortField.Field)) * sortField.Direction
 			if comparison != 0 {
 				return comparison < 0
 			}
 		}
+		return byID && compareValues(a["_id"], b["_id"]) < 0
+	}
+}
+
+// sortWindow returns the documents that fall in [skip, skip+limit) of the
+// sorted order, and the strategy it used. A limit of zero means no limit.
+// When skip+limit is small next to the input, only that many documents are
+// kept, in a bounded heap, instead of sorting everything.
+func sortWindow(documents []map[string]interface{}, sortFields []SortField, skip, limit int) ([]map[string]interface{}, string) {
+	skip = max(skip, 0)
+
+	strategy := sortStrategyFull
+	switch {
+	case len(sortFields) == 0:
+		strategy = sortStrategyNone
+	case limit > 0 && (skip+limit)*topKMaxFraction <= len(documents):
+		strategy = sortStrategyTopK
+	}
+
+	switch strategy {
+	case sortStrategyFull:
+		sortWithLess(documents, documentLess(sortFields))
+	case sortStrategyTopK:
+		documents = topK(documents, skip+limit, documentLess(sortFields))
+	}
+
+	start := min(skip, len(documents))
+	end := len(documents)
+	if limit > 0 {
+		end = min(start+limit, end)
+	}
+	return documents[start:end], strategy
+}
+
+// documentHeap is a max-heap of positions in documents under less, with
+// ties going to the later position: its root is the document that would be
+// dropped first.
+type documentHeap struct {
+	documents []map[string]interface{}
+	positions []int
+	less      func(a, b map[string]interface{}) bool
+}
+
+// before reports whether the document at position p sorts before the one at
+// q, falling back to input order.
+func (h *documentHeap) before(p, q int) bool {
+	if h.less(h.documents[p], h.documents[q]) {
+		return true
+	}
+	if h.less(h.documents[q], h.documents[p]) {
 		return false
+	}
+	return p < q
+}
+
+func (h *documentHeap) Len() int {
+	return len(h.positions)
+}
+
+func (h *documentHeap) Less(i, j int) bool {
+	return h.before(h.positions[j], h.positions[i])
+}
+
+func (h *documentHeap) Swap(i, j int) {
+	h.positions[i], h.positions[j] = h.positions[j], h.positions[i]
+}
+
+func (h *documentHeap) Push(x interface{}) {
+	h.positions = append(h.positions, x.(int))
+}
+
+func (h *documentHeap) Pop() interface{} {
+	last := h.positions[len(h.positions)-1]
+	h.positions = h.positions[:len(h.positions)-1]
+	return last
+}
+
+// topK returns the first k documents under less, in order, in O(n log k).
+// Documents that compare equal keep their input order, as they would in a
+// full stable sort.
+func topK(documents []map[string]interface{}, k int, less func(a, b map[string]interface{}) bool) []map[string]interface{} {
+	h := &documentHeap{documents: documents, positions: make([]int, 0, k), less: less}
+	for i := range documents {
+		if h.Len() < k {
+			heap.Push(h, i)
+		} else if h.before(i, h.positions[0]) {
+			h.positions[0] = i
+			heap.Fix(h, 0)
+		}
+	}
+
+	sort.Slice(h.positions, func(i, j int) bool {
+		return h.before(h.positions[i], h.positions[j])
 	})
+	result := make([]map[string]interface{}, len(h.positions))
+	for i, position := range h.positions {
+		result[i] = documents[position]
+	}
+	return result
+}
 
-	result, _ := json.Marshal(map[string]interface{}{"results": documents})
-	return string(result)
+// sortWithLess sorts documents stably, so that documents less cannot tell
+// apart keep their input order.
+func sortWithLess(documents []map[string]interface{}, less func(a, b map[string]interface{}) bool) {
+	sort.SliceStable(documents, func(i, j int) bool {
+		return less(documents[i], documents[j])
+	})
 }
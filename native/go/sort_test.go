@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// sortTestDocuments returns n documents with only a few distinct values of
+// "group", in a shuffled order, so most sort keys are shared.
+func sortTestDocuments(n int, seed int64) []map[string]interface{} {
+	documents := make([]map[string]interface{}, n)
+	for i := range documents {
+		documents[i] = map[string]interface{}{
+			"_id":   fmt.Sprintf("doc-%04d", i),
+			"group": float64(i % 3),
+			"name":  fmt.Sprintf("name-%d", i%5),
+		}
+	}
+	rand.New(rand.NewSource(seed)).Shuffle(n, func(i, j int) {
+		documents[i], documents[j] = documents[j], documents[i]
+	})
+	return documents
+}
+
+func TestSortEqualKeysByID(t *testing.T) {
+	for _, direction := range []int{1, -1} {
+		sorted, _ := sortWindow(sortTestDocuments(30, 1), []SortField{{Field: "group", Direction: direction}}, 0, 0)
+		for i := 1; i < len(sorted); i++ {
+			previous, current := sorted[i-1], sorted[i]
+			cmp := compareValues(previous["group"], current["group"]) * direction
+			if cmp > 0 {
+				t.Fatalf("direction %d: %v sorted before %v", direction, previous, current)
+			}
+			if cmp == 0 && previous["_id"].(string) >= current["_id"].(string) {
+				t.Fatalf("direction %d: equal keys not in _id order: %v then %v", direction, previous["_id"], current["_id"])
+			}
+		}
+	}
+}
+
+func TestSortByIDHasNoTiebreak(t *testing.T) {
+	sorted, _ := sortWindow(sortTestDocuments(30, 2), []SortField{{Field: "_id", Direction: -1}}, 0, 0)
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1]["_id"].(string) <= sorted[i]["_id"].(string) {
+			t.Fatalf("_id descending: %v before %v", sorted[i-1]["_id"], sorted[i]["_id"])
+		}
+	}
+}
+
+// Every strategy has to produce the same pages, whatever order the documents
+// arrive in, or paging through a result skips and repeats documents.
+func TestSortPagesAgreeAcrossStrategies(t *testing.T) {
+	const n, pageSize = 200, 10
+	sortFields := []SortField{{Field: "group", Direction: -1}, {Field: "name", Direction: 1}}
+	want := documentIDs(func() []map[string]interface{} {
+		sorted, _ := sortWindow(sortTestDocuments(n, 3), sortFields, 0, 0)
+		return sorted
+	}())
+
+	strategies := make(map[string]bool)
+	seen := make(map[string]bool)
+	for skip := 0; skip < n; skip += pageSize {
+		wantPage := want[skip : skip+pageSize]
+
+		page, strategy := sortWindow(sortTestDocuments(n, int64(skip)), sortFields, skip, pageSize)
+		strategies[strategy] = true
+		if got := documentIDs(page); !equalIDs(got, wantPage) {
+			t.Errorf("skip %d, %s: got %v, want %v", skip, strategy, got, wantPage)
+		}
+
+		var streamed []map[string]interface{}
+		external := newExternalSort(sortTestDocuments(n, int64(skip)+1), sortFields, skip, pageSize, 512, t.TempDir())
+		result, err := external.stream(func(part interface{}) {
+			streamed = append(streamed, part.(map[string]interface{})["results"].([]map[string]interface{})...)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		final := result.(map[string]interface{})
+		streamed = append(streamed, final["results"].([]map[string]interface{})...)
+		strategies[final["strategy"].(string)] = true
+		if got := documentIDs(streamed); !equalIDs(got, wantPage) {
+			t.Errorf("skip %d, %s: got %v, want %v", skip, final["strategy"], got, wantPage)
+		}
+
+		for _, id := range wantPage {
+			if seen[id] {
+				t.Errorf("%s appears on two pages", id)
+			}
+			seen[id] = true
+		}
+	}
+
+	for _, strategy := range []string{sortStrategyFull, sortStrategyTopK, sortStrategyExternal} {
+		if !strategies[strategy] {
+			t.Errorf("no page used the %s strategy", strategy)
+		}
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	ab := []SortField{{Field: "b", Direction: 1}, {Field: "a", Direction: -1}}
+	tests := []struct {
+		raw  interface{}
+		want []SortField
+	}{
+		{nil, nil},
+		{"", nil},
+		{[]interface{}{}, nil},
+		{`{"b": 1, "a": -1}`, ab},
+		{`[["b", 1], ["a", -1]]`, ab},
+		{[]interface{}{[]interface{}{"b", float64(1)}, []interface{}{"a", float64(-1)}}, ab},
+		{map[string]interface{}{"a": float64(-1)}, []SortField{{Field: "a", Direction: -1}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSort(tt.raw)
+		if err != nil {
+			t.Errorf("%#v: %v", tt.raw, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%#v: got %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+
+	for _, raw := range []interface{}{
+		map[string]interface{}{"b": float64(1), "a": float64(-1)},
+		map[string]interface{}{"a": float64(0)},
+		map[string]interface{}{"a": "desc"},
+		`{"a": 0}`,
+		`{"a": "desc"}`,
+		`{"a": 2}`,
+		`[["a", 0]]`,
+		`[["a", "desc"]]`,
+		`"a"`,
+		float64(1),
+	} {
+		if _, err := parseSort(raw); err == nil {
+			t.Errorf("%#v was accepted", raw)
+		}
+	}
+}
+
+// The JSON codec has the request text, so a plain sort object keeps the
+// order of its fields all the way to parseSort.
+func TestJSONRequestKeepsSortOrder(t *testing.T) {
+	for _, params := range []string{
+		`{"sort": {"b": 1, "a": -1}}`,
+		`{"sort": "{\"b\": 1, \"a\": -1}"}`,
+		`{"sort": [["b", 1], ["a", -1]]}`,
+	} {
+		req, err := jsonCodec{}.DecodeRequest([]byte(`{"id": 1, "method": "sortDocuments", "params": ` + params + `}`))
+		if err != nil {
+			t.Fatalf("%s: %v", params, err)
+		}
+		got, err := sortParam(req.Params, "sort")
+		if err != nil {
+			t.Fatalf("%s: %v", params, err)
+		}
+		if want := []SortField{{Field: "b", Direction: 1}, {Field: "a", Direction: -1}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", params, got, want)
+		}
+	}
+}
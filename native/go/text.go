@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type TextSearch struct {
+	Terms         []string
+	Phrases       []string
+	Negated       []string
+	CaseSensitive bool
+}
+
+// parseTextSearch accepts either a search string or {$search, $caseSensitive}.
+// Quoted phrases must all appear, terms prefixed with "-" must not, and at
+// least one of the remaining terms must match.
+func parseTextSearch(value interface{}) (*TextSearch, error) {
+	var search string
+	parsed := &TextSearch{}
+
+	switch v := value.(type) {
+	case string:
+		search = v
+	case map[string]interface{}:
+		s, ok := v["$search"].(string)
+		if !ok {
+			return nil, fmt.Errorf("$text requires a $search string")
+		}
+		search = s
+		if caseSensitive, ok := v["$caseSensitive"].(bool); ok {
+			parsed.CaseSensitive = caseSensitive
+		}
+	default:
+		return nil, fmt.Errorf("$text requires a string or an object with $search")
+	}
+
+	normalize := func(s string) string {
+		if parsed.CaseSensitive {
+			return s
+		}
+		return strings.ToLower(s)
+	}
+
+	for {
+		start := strings.IndexByte(search, '"')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(search[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		phrase := strings.TrimSpace(search[start+1 : start+1+end])
+		if phrase != "" {
+			parsed.Phrases = append(parsed.Phrases, normalize(phrase))
+		}
+		search = search[:start] + " " + search[start+1+end+1:]
+	}
+
+	for _, word := range strings.Fields(search) {
+		if strings.HasPrefix(word, "-") {
+			if term := strings.TrimLeft(word, "-"); term != "" {
+				parsed.Negated = append(parsed.Negated, normalize(term))
+			}
+			continue
+		}
+		parsed.Terms = append(parsed.Terms, normalize(word))
+	}
+
+	if len(parsed.Terms) == 0 && len(parsed.Phrases) == 0 {
+		return nil, fmt.Errorf("$text search is empty")
+	}
+	return parsed, nil
+}
+
+func collectText(value interface{}, out *strings.Builder) {
+	switch v := value.(type) {
+	case string:
+		out.WriteString(v)
+		out.WriteByte(' ')
+	case []interface{}:
+		for _, element := range v {
+			collectText(element, out)
+		}
+	case pathValues:
+		for _, element := range v {
+			collectText(element, out)
+		}
+	case map[string]interface{}:
+		for _, element := range v {
+			collectText(element, out)
+		}
+	}
+}
+
+func (t *TextSearch) Matches(value interface{}) bool {
+	var builder strings.Builder
+	collectText(value, &builder)
+	text := builder.String()
+	if text == "" {
+		return false
+	}
+	if !t.CaseSensitive {
+		text = strings.ToLower(text)
+	}
+
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words[word] = true
+	}
+
+	for _, term := range t.Negated {
+		if words[term] {
+			return false
+		}
+	}
+	for _, phrase := range t.Phrases {
+		if !strings.Contains(text, phrase) {
+			return false
+		}
+	}
+	if len(t.Terms) == 0 {
+		return true
+	}
+	for _, term := range t.Terms {
+		if words[term] {
+			return true
+		}
+	}
+	return false
+}
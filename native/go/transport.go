@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	framingLine   = "line"
+	framingLength = "length"
+
+	frameHeaderSize     = 8
+	defaultMaxFrameSize = 256 << 20
+)
+
+type FrameTooLargeError struct {
+	Size int64
+	Max  int64
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("frame of %d bytes exceeds max frame size of %d bytes", e.Size, e.Max)
+}
+
+type transport interface {
+	Framing() string
+	MaxFrameSize() int64
+	ReadMessage() ([]byte, uint32, error)
+	WriteMessage(payload []byte, id uint32) error
+}
+
+// lineTransport is the original newline-delimited mode. Line ids are always
+// zero; the request id lives in the message body.
+type lineTransport struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	maxSize int64
+}
+
+func newLineTransport(r *bufio.Reader, w *bufio.Writer, maxSize int64) *lineTransport {
+	return &lineTransport{r: r, w: w, maxSize: maxSize}
+}
+
+func (t *lineTransport) Framing() string     { return framingLine }
+func (t *lineTransport) MaxFrameSize() int64 { return t.maxSize }
+
+func (t *lineTransport) ReadMessage() ([]byte, uint32, error) {
+	var line []byte
+	for {
+		chunk, err := t.r.ReadSlice('\n')
+		if int64(len(line)+len(chunk)) > t.maxSize {
+			size := int64(len(line) + len(chunk))
+			for err == bufio.ErrBufferFull {
+				chunk, err = t.r.ReadSlice('\n')
+				size += int64(len(chunk))
+			}
+			return nil, 0, &FrameTooLargeError{Size: size, Max: t.maxSize}
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return bytes.TrimSpace(line), 0, nil
+			}
+			return nil, 0, err
+		}
+		return bytes.TrimSpace(line), 0, nil
+	}
+}
+
+func (t *lineTransport) WriteMessage(payload []byte, id uint32) error {
+	if _, err := t.w.Write(payload); err != nil {
+		return err
+	}
+	if err := t.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	return t.w.Flush()
+}
+
+// frameTransport prefixes every message with an 8-byte header: a big-endian
+// uint32 payload length followed by a big-endian uint32 request id. The id
+// lets an oversized frame be rejected without decoding its body.
+type frameTransport struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	maxSize int64
+}
+
+func newFrameTransport(r *bufio.Reader, w *bufio.Writer, maxSize int64) *frameTransport {
+	return &frameTransport{r: r, w: w, maxSize: maxSize}
+}
+
+func (t *frameTransport) Framing() string     { return framingLength }
+func (t *frameTransport) MaxFrameSize() int64 { return t.maxSize }
+
+func (t *frameTransport) ReadMessage() ([]byte, uint32, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(t.r, header[:]); err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	id := binary.BigEndian.Uint32(header[4:8])
+
+	if size > t.maxSize {
+		if _, err := io.CopyN(io.Discard, t.r, size); err != nil {
+			return nil, id, err
+		}
+		return nil, id, &FrameTooLargeError{Size: size, Max: t.maxSize}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(t.r, payload); err != nil {
+		return nil, id, err
+	}
+	return payload, id, nil
+}
+
+func (t *frameTransport) WriteMessage(payload []byte, id uint32) error {
+	if int64(len(payload)) > math.MaxUint32 {
+		return &FrameTooLargeError{Size: int64(len(payload)), Max: math.MaxUint32}
+	}
+
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], id)
+
+	if _, err := t.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := t.w.Write(payload); err != nil {
+		return err
+	}
+	return t.w.Flush()
+}
+
+func frameID(id interface{}) uint32 {
+	switch v := id.(type) {
+	case uint32:
+		return v
+	case float64:
+		if v > 0 && v <= math.MaxUint32 && v == math.Trunc(v) {
+			return uint32(v)
+		}
+	}
+	return 0
+}
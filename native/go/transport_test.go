@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// serveInput runs serve over input with the transport start returns and the
+// JSON codec, and returns everything it wrote.
+func serveInput(t *testing.T, input []byte, start func(r *bufio.Reader, w *bufio.Writer) transport) []byte {
+	t.Helper()
+	savedIn, savedOut, savedConn, savedEnc := stdin, stdout, conn, enc
+	defer func() {
+		stdin, stdout, conn, enc = savedIn, savedOut, savedConn, savedEnc
+	}()
+
+	var output bytes.Buffer
+	stdin = bufio.NewReader(bytes.NewReader(input))
+	stdout = bufio.NewWriter(&output)
+	conn = start(stdin, stdout)
+	enc = jsonCodec{}
+	serve()
+	return output.Bytes()
+}
+
+func frame(id uint32, payload []byte) []byte {
+	header := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], id)
+	return append(header, payload...)
+}
+
+func decodeJSONResponse(t *testing.T, payload []byte) map[string]interface{} {
+	t.Helper()
+	var resp map[string]interface{}
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		t.Fatalf("response %q: %v", payload, err)
+	}
+	return resp
+}
+
+// The reader's buffer is smaller than the lines, so each of them is read in
+// several slices.
+func TestLineTransportRejectsLongLines(t *testing.T) {
+	input := strings.Repeat("x", 100) + "\n" + `{"id":1}` + "\n" + strings.Repeat("y", 30) + "\n"
+	line := newLineTransport(bufio.NewReaderSize(strings.NewReader(input), 16), nil, 40)
+
+	_, _, err := line.ReadMessage()
+	var tooLarge *FrameTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != 101 || tooLarge.Max != 40 {
+		t.Fatalf("long line: got %v, want a 101-byte line over the 40-byte max", err)
+	}
+
+	for _, want := range []string{`{"id":1}`, strings.Repeat("y", 30)} {
+		payload, _, err := line.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != want {
+			t.Errorf("got %q, want %q", payload, want)
+		}
+	}
+	if _, _, err := line.ReadMessage(); err != io.EOF {
+		t.Errorf("after the last line: got %v, want EOF", err)
+	}
+}
+
+func TestFrameTransportDrainsOversizedFrames(t *testing.T) {
+	input := append(frame(7, bytes.Repeat([]byte("x"), 100)), frame(8, []byte(`{"id":8,"method":"noSuchMethod"}`))...)
+	output := serveInput(t, input, func(r *bufio.Reader, w *bufio.Writer) transport {
+		return newFrameTransport(r, w, 50)
+	})
+
+	responses := newFrameTransport(bufio.NewReader(bytes.NewReader(output)), nil, defaultMaxFrameSize)
+	payload, id, err := responses.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := decodeJSONResponse(t, payload)
+	if id != 7 || resp["id"] != float64(7) {
+		t.Errorf("oversized frame answered with header id %d, body id %v; want 7", id, resp["id"])
+	}
+	if message, _ := resp["error"].(string); !strings.Contains(message, "exceeds max frame size") {
+		t.Errorf("oversized frame answered with %v", resp)
+	}
+
+	// The next frame is read from where the oversized one ended.
+	payload, id, err = responses.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = decodeJSONResponse(t, payload)
+	if id != 8 || resp["error"] != "unknown method: noSuchMethod" {
+		t.Errorf("next frame: id %d, response %v", id, resp)
+	}
+}
+
+// Requests already in flight are answered on the line transport before the
+// handshake's own response, and everything after it uses length frames and
+// msgpack.
+func TestHandshakeSwitchesAfterRequestsInFlight(t *testing.T) {
+	const inFlight = 8
+	params := map[string]interface{}{
+		"documents": []interface{}{map[string]interface{}{"_id": "b"}, map[string]interface{}{"_id": "a"}},
+		"sort":      []interface{}{[]interface{}{"_id", float64(1)}},
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input bytes.Buffer
+	for id := 1; id <= inFlight; id++ {
+		fmt.Fprintf(&input, `{"id":%d,"method":"sortDocuments","params":%s}`+"\n", id, paramsJSON)
+	}
+	input.WriteString(`{"id":100,"method":"handshake","params":{"framing":"length","encoding":"msgpack"}}` + "\n")
+	request, err := msgpackMarshal(map[string]interface{}{"id": 101, "method": "sortDocuments", "params": params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.Write(frame(101, request))
+
+	output := serveInput(t, input.Bytes(), func(r *bufio.Reader, w *bufio.Writer) transport {
+		return newLineTransport(r, w, defaultMaxFrameSize)
+	})
+
+	reader := bufio.NewReader(bytes.NewReader(output))
+	lines := newLineTransport(reader, nil, defaultMaxFrameSize)
+	answered := make(map[float64]bool)
+	for i := 0; i < inFlight; i++ {
+		payload, _, err := lines.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := decodeJSONResponse(t, payload)
+		id, _ := resp["id"].(float64)
+		if id < 1 || id > inFlight || answered[id] {
+			t.Fatalf("line %d: got response %v before the handshake", i, resp)
+		}
+		answered[id] = true
+	}
+	payload, _, err := lines.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := decodeJSONResponse(t, payload)
+	result, _ := resp["result"].(map[string]interface{})
+	if resp["id"] != float64(100) || result["framing"] != framingLength || result["encoding"] != encodingMsgpack {
+		t.Fatalf("handshake answered with %v", resp)
+	}
+
+	frames := newFrameTransport(reader, nil, defaultMaxFrameSize)
+	payload, id, err := frames.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msgpackUnmarshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted, _ := decoded.(map[string]interface{})["result"].(map[string]interface{})
+	results, _ := sorted["results"].([]interface{})
+	if id != 101 || len(results) != 2 || results[0].(map[string]interface{})["_id"] != "a" {
+		t.Errorf("request after the handshake: frame id %d, response %v", id, decoded)
+	}
+	if _, _, err := frames.ReadMessage(); err != io.EOF {
+		t.Errorf("after the last frame: got %v, want EOF", err)
+	}
+}
@@ -1,31 +1,5 @@
 package main
 
-import (
-	"encoding/json"
-	"reflect"
-)
-
-func deepEqual(a, b interface{}) bool {
-	if a == nil && b == nil {
-		return true
-	}
-	if a == nil || b == nil {
-		return false
-	}
-
-	if reflect.TypeOf(a) != reflect.TypeOf(b) {
-		return false
-	}
-
-	aJSON, errA := json.Marshal(a)
-	bJSON, errB := json.Marshal(b)
-	if errA != nil || errB != nil {
-		return false
-	}
-
-	return string(aJSON) == string(bJSON)
-}
-
 func toNumber(v interface{}) (float64, bool) {
 	switch val := v.(type) {
 	case float64:
@@ -69,4 +43,3 @@ func max(a, b int) int {
 	}
 	return b
 }
-
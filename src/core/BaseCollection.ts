@@ -13,6 +13,17 @@ export type DocumentWithMetadata = Document & {
   _version?: number;
 };
 
+/** Whether error came from the native sidecar with the given code
+ * @param error Error to check
+ * @param code Sidecar error code, such as `DUPLICATE_KEY` */
+export function isNativeError(error: unknown, code: string): boolean {
+  return (
+    error instanceof Error &&
+    error.name === 'NativeError' &&
+    (error as { code?: string }).code === code
+  );
+}
+
 /** @typeParam T Document type for this collection */
 export abstract class BaseCollection<T = Document> {
   protected name: string;
@@ -137,12 +148,73 @@ export abstract class BaseCollection<T = Document> {
   }
 
   /** @param document Document being modified
-   * @param operation Type of operation (insert/update/delete) */
+   * @param operation Type of operation (insert/update/delete)
+   * @param previous Document before an update */
   protected async updateIndexes(
     document: T & DocumentWithMetadata,
-    operation: 'insert' | 'update' | 'delete'
+    operation: 'insert' | 'update' | 'delete',
+    previous?: T & DocumentWithMetadata
+  ): Promise<void> {
+    this.indexManager.updateIndexes(document, operation, previous);
+  }
+
+  /** Apply a write to the native resolver's indexes. Inserts and updates call
+   * this before the document is stored: a duplicate key in a unique index
+   * rejects with a NativeError whose code is `DUPLICATE_KEY` and leaves the
+   * indexes as they were. Any other failure drops the native indexes, so
+   * queries scan instead of missing the document.
+   * @param document Document being modified
+   * @param operation Type of operation (insert/update/delete)
+   * @param previous Document before an update */
+  protected async updateNativeIndexes(
+    document: T & DocumentWithMetadata,
+    operation: 'insert' | 'update' | 'delete',
+    previous?: T & DocumentWithMetadata
   ): Promise<void> {
-    this.indexManager.updateIndexes(document, operation);
+    const keys = this.indexManager.indexKeys(document);
+    if (Object.keys(keys).length === 0) return;
+
+    const engine = await this.nativeEngine();
+    if (!engine) return;
+
+    const scope = this.nativeScope();
+    try {
+      if (operation === 'insert') {
+        await engine.indexInsert(scope, document._id, keys);
+      } else if (operation === 'delete') {
+        await engine.indexDelete(scope, document._id, keys);
+      } else {
+        const oldKeys = previous ? this.indexManager.indexKeys(previous) : {};
+        await engine.indexUpdate(scope, document._id, oldKeys, keys);
+      }
+    } catch (error) {
+      if (isNativeError(error, 'DUPLICATE_KEY')) throw error;
+      // A collection without native indexes has nothing to keep in step.
+      if (isNativeError(error, 'NO_INDEXES')) return;
+      await engine.dropIndexes(scope);
+    }
+  }
+
+  /** Forget the native resolver's indexes, after a write they may have missed */
+  protected async dropNativeIndexes(): Promise<void> {
+    const engine = await this.nativeEngine();
+    if (engine) {
+      await engine.dropIndexes(this.nativeScope());
+    }
+  }
+
+  private nativeScope(): { collection: string; database: string } {
+    return { collection: this.name, database: this.storage.getBasePath() };
+  }
+
+  private async nativeEngine(): Promise<any | null> {
+    try {
+      // @ts-ignore - Dynamic import for optional native bindings
+      const { NativeFilterEngine } = await import('../native/bindings');
+      return NativeFilterEngine.isAvailable() ? NativeFilterEngine : null;
+    } catch {
+      return null;
+    }
   }
 
   /** @param document Document to extract key from
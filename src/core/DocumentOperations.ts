@@ -8,7 +8,7 @@ import type {
   QueryFilter,
 } from './types';
 import type { DocumentWithMetadata } from './BaseCollection';
-import { BaseCollection } from './BaseCollection';
+import { BaseCollection, isNativeError } from './BaseCollection';
 import { DocumentError } from '../errors/DatabaseError';
 import { QueryOperations } from './QueryOperations';
 import { CollectionOptions } from './types';
@@ -19,6 +19,13 @@ import {
   IndexManager,
 } from './document';
 
+/** A write applied to the native indexes: the new document, and on update
+ * the document it replaces */
+interface NativeIndexChange<T> {
+  document: T & DocumentWithMetadata;
+  previous?: T & DocumentWithMetadata;
+}
+
 /** @typeParam T Document type for this collection */
 export class DocumentOperations<T = Document> extends BaseCollection<T> {
   private queryOps: QueryOperations<T>;
@@ -51,7 +58,17 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
       const document = this.processor.createDocument(processedData);
       const documentToStore = this.encryption.encrypt(document);
 
-      await this.storage.writeDocument(this.name, documentToStore);
+      if (this.options.autoIndex) {
+        await this.applyNativeIndexes([{ document }]);
+      }
+      try {
+        await this.storage.writeDocument(this.name, documentToStore);
+      } catch (error) {
+        if (this.options.autoIndex) {
+          await this.revertNativeIndexes([{ document }]);
+        }
+        throw error;
+      }
 
       this.cache.set(document._id, document as T);
 
@@ -66,6 +83,7 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
         insertedCount: 1,
       };
     } catch (error) {
+      if (isNativeError(error, 'DUPLICATE_KEY')) throw error;
       throw new DocumentError(
         `Insert failed: ${error instanceof Error ? error.message : 'Unknown error'}`
       );
@@ -95,12 +113,18 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
         }
       }
 
+      if (this.options.autoIndex) {
+        await this.applyNativeIndexes(
+          processedDocuments.map(document => ({ document }))
+        );
+      }
+
       const writePromises = processedDocuments.map(async document => {
         const documentToStore = this.encryption.encrypt(document);
         return this.storage.writeDocument(this.name, documentToStore);
       });
 
-      await Promise.all(writePromises);
+      await this.settleWrites(writePromises);
 
       const indexUpdates: Promise<void>[] = [];
       processedDocuments.forEach(document => {
@@ -125,6 +149,7 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
         success: true,
       };
     } catch (error) {
+      if (isNativeError(error, 'DUPLICATE_KEY')) throw error;
       throw new DocumentError(
         `InsertMany failed: ${error instanceof Error ? error.message : 'Unknown error'}`
       );
@@ -147,44 +172,42 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
         return { modifiedCount: 0, success: true };
       }
 
-      let modifiedCount = 0;
-      const updatePromises: Promise<void>[] = [];
-      const indexUpdatePromises: Promise<void>[] = [];
-
-      for (const document of documents.documents) {
-        const docWithMetadata = document as T & DocumentWithMetadata;
-        const updatedDocument = this.processor.updateDocument(
-          docWithMetadata,
-          updateData
-        );
-        const documentToStore = this.encryption.encrypt(updatedDocument);
+      const changes = documents.documents.map(document => {
+        const previous = document as T & DocumentWithMetadata;
+        return {
+          document: this.processor.updateDocument(previous, updateData),
+          previous,
+        };
+      });
 
-        updatePromises.push(
-          this.storage.writeDocument(this.name, documentToStore)
-        );
+      if (this.options.autoIndex) {
+        await this.applyNativeIndexes(changes);
+      }
 
-        this.cache.set(updatedDocument._id, updatedDocument as T);
+      const updatePromises = changes.map(({ document }) => {
+        const documentToStore = this.encryption.encrypt(document);
+        this.cache.set(document._id, document as T);
+        return this.storage.writeDocument(this.name, documentToStore);
+      });
 
-        if (this.options.autoIndex) {
-          indexUpdatePromises.push(
-            this.updateIndexes(updatedDocument, 'update')
-          );
-        }
+      await this.settleWrites(updatePromises);
 
-        modifiedCount++;
+      if (this.options.autoIndex) {
+        await Promise.all(
+          changes.map(({ document, previous }) =>
+            this.updateIndexes(document, 'update', previous)
+          )
+        );
       }
 
-      await Promise.all(updatePromises);
-
-      if (indexUpdatePromises.length > 0) {
-        await Promise.all(indexUpdatePromises);
-      }
+      const modifiedCount = changes.length;
 
       return {
         modifiedCount,
         success: true,
       };
     } catch (error) {
+      if (isNativeError(error, 'DUPLICATE_KEY')) throw error;
       throw new DocumentError(
         `Update failed: ${error instanceof Error ? error.message : 'Unknown error'}`
       );
@@ -234,6 +257,7 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
 
           if (this.options.autoIndex) {
             await this.updateIndexes(docWithMetadata, 'delete');
+            await this.updateNativeIndexes(docWithMetadata, 'delete');
           }
 
           deletedCount++;
@@ -263,6 +287,64 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
     return this.delete({ _id: docWithMetadata._id });
   }
 
+  /** Add inserted or updated documents to the native indexes one at a time,
+   * before they are stored, so a duplicate key within the batch or with a
+   * stored document is caught before anything is written. If one is rejected,
+   * the changes already made are reverted.
+   * @param changes New documents, with the document they replace on update */
+  private async applyNativeIndexes(
+    changes: NativeIndexChange<T>[]
+  ): Promise<void> {
+    const applied: NativeIndexChange<T>[] = [];
+    try {
+      for (const { document, previous } of changes) {
+        await this.updateNativeIndexes(
+          document,
+          previous ? 'update' : 'insert',
+          previous
+        );
+        applied.push({ document, previous });
+      }
+    } catch (error) {
+      await this.revertNativeIndexes(applied);
+      throw error;
+    }
+  }
+
+  /** @param changes Changes made by applyNativeIndexes, to undo */
+  private async revertNativeIndexes(
+    changes: NativeIndexChange<T>[]
+  ): Promise<void> {
+    try {
+      for (const { document, previous } of changes.reverse()) {
+        if (previous) {
+          await this.updateNativeIndexes(previous, 'update', document);
+        } else {
+          await this.updateNativeIndexes(document, 'delete');
+        }
+      }
+    } catch {
+      await this.dropNativeIndexes();
+    }
+  }
+
+  /** Wait for every write. If any failed, some documents may be stored
+   * without matching native index entries or the other way round, so the
+   * native indexes are dropped before the first error is rethrown.
+   * @param writes Pending document writes */
+  private async settleWrites(writes: Promise<void>[]): Promise<void> {
+    const results = await Promise.allSettled(writes);
+    const failed = results.find(
+      (result): result is PromiseRejectedResult => result.status === 'rejected'
+    );
+    if (failed) {
+      if (this.options.autoIndex) {
+        await this.dropNativeIndexes();
+      }
+      throw failed.reason;
+    }
+  }
+
   /** @param definition Index definition with fields and options */
   async createIndex(definition: IndexDefinition): Promise<void> {
     await this.ensureInitialized();
@@ -271,7 +353,10 @@ export class DocumentOperations<T = Document> extends BaseCollection<T> {
       definition.name || Object.keys(definition.fields).join('_');
 
     const documents = await this.getAllDocuments();
-    this.indexManager.createIndex(documents, definition.fields, indexName);
+    this.indexManager.createIndex(documents, definition.fields, indexName, {
+      unique: definition.unique,
+      sparse: definition.sparse,
+    });
 
     if (this.queryOps && (this.queryOps as any).rebuildIndexResolver) {
       await (this.queryOps as any).rebuildIndexResolver();
@@ -42,7 +42,8 @@ export class QueryOperations<T = Document> extends BaseCollection<T> {
     );
     this.indexResolver = new IndexQueryResolver(
       this.indexes,
-      this.indexManager.fieldMetadata
+      this.indexManager.fieldMetadata,
+      { collection: this.name, database: this.storage.getBasePath() }
     );
     this.filterEngine = new QueryFilterEngine<T>();
     this.sorter = new QuerySorter<T>();
@@ -53,7 +54,8 @@ export class QueryOperations<T = Document> extends BaseCollection<T> {
   public async rebuildIndexResolver(): Promise<void> {
     this.indexResolver = new IndexQueryResolver(
       this.indexes,
-      this.indexManager.fieldMetadata
+      this.indexManager.fieldMetadata,
+      { collection: this.name, database: this.storage.getBasePath() }
     );
     await this.indexResolver.rebuildFieldMapping();
   }
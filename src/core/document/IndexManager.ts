@@ -5,7 +5,14 @@ import type { Schema } from '../types';
 /** Index metadata for tracking field coverage */
 export interface IndexFieldMetadata {
   fields: string[];
+  /** Direction of each entry in `fields`; ascending when omitted */
+  directions?: Array<1 | -1>;
   indexName: string;
+  unique?: boolean;
+  /** Leave out documents whose key is missing or null */
+  sparse?: boolean;
+  /** Set once a document's value is an array, which is indexed under each of its elements */
+  multikey?: boolean;
 }
 
 /** Manages index operations for collections */
@@ -25,23 +32,30 @@ export class IndexManager<T = Document> {
     for (const [fieldName, fieldDef] of Object.entries(this.schema)) {
       if (fieldDef.index) {
         const indexMap = new Map<any, string[]>();
+        let multikey = false;
 
         for (let i = 0; i < documents.length; i++) {
           const document = documents[i];
           const docWithMetadata = document as T & DocumentWithMetadata;
           const value = (document as any)[fieldName];
-          let ids = indexMap.get(value);
-          if (!ids) {
-            ids = [];
-            indexMap.set(value, ids);
+          multikey = multikey || Array.isArray(value);
+          for (const key of this.elementKeys(value)) {
+            let ids = indexMap.get(key);
+            if (!ids) {
+              ids = [];
+              indexMap.set(key, ids);
+            }
+            ids.push(docWithMetadata._id);
           }
-          ids.push(docWithMetadata._id);
         }
 
         this.indexes.set(fieldName, indexMap);
         this.fieldMetadata.set(fieldName, {
           fields: [fieldName],
+          directions: [1],
           indexName: fieldName,
+          unique: fieldDef.unique,
+          multikey,
         });
       }
     }
@@ -49,39 +63,62 @@ export class IndexManager<T = Document> {
 
   /** Update indexes when a document is modified
    * @param document Document being modified
-   * @param operation Type of operation (insert/update/delete) */
+   * @param operation Type of operation (insert/update/delete)
+   * @param previous Document before an update, whose keys are removed */
   updateIndexes(
     document: T & DocumentWithMetadata,
-    operation: 'insert' | 'update' | 'delete'
+    operation: 'insert' | 'update' | 'delete',
+    previous?: T & DocumentWithMetadata
   ): void {
     if (!this.schema) return;
 
+    if (operation === 'update' && previous) {
+      this.updateIndexes(previous, 'delete');
+    }
+
     for (const [fieldName, fieldDef] of Object.entries(this.schema)) {
       if (fieldDef.index && this.indexes.has(fieldName)) {
         const index = this.indexes.get(fieldName)!;
         const value = (document as any)[fieldName];
+        const metadata = this.fieldMetadata.get(fieldName);
+        if (metadata && Array.isArray(value)) {
+          metadata.multikey = true;
+        }
 
-        if (operation === 'delete') {
-          const documentIds = index.get(value) || [];
-          const updatedIds = documentIds.filter(id => id !== document._id);
-          if (updatedIds.length === 0) {
-            index.delete(value);
+        for (const key of this.elementKeys(value)) {
+          if (operation === 'delete') {
+            const documentIds = index.get(key) || [];
+            const updatedIds = documentIds.filter(id => id !== document._id);
+            if (updatedIds.length === 0) {
+              index.delete(key);
+            } else {
+              index.set(key, updatedIds);
+            }
           } else {
-            index.set(value, updatedIds);
-          }
-        } else {
-          if (!index.has(value)) {
-            index.set(value, []);
-          }
-          const documentIds = index.get(value)!;
-          if (!documentIds.includes(document._id)) {
-            documentIds.push(document._id);
+            if (!index.has(key)) {
+              index.set(key, []);
+            }
+            const documentIds = index.get(key)!;
+            if (!documentIds.includes(document._id)) {
+              documentIds.push(document._id);
+            }
           }
         }
       }
     }
   }
 
+  /** Keys a single-field value is indexed under: each distinct element of a
+   * non-empty array, otherwise the value itself
+   * @param value Field value
+   * @returns Index keys */
+  elementKeys(value: unknown): unknown[] {
+    if (Array.isArray(value) && value.length > 0) {
+      return Array.from(new Set(value));
+    }
+    return [value];
+  }
+
   /** Extract index key from document
    * @param document Document to extract key from
    * @param fields Fields to include in index key
@@ -100,36 +137,63 @@ export class IndexManager<T = Document> {
     return keys.map(key => (document as Record<string, unknown>)[key]);
   }
 
+  /** Key of a document in every index, by index name
+   * @param document Document to extract keys from
+   * @returns Index keys */
+  indexKeys(document: T & DocumentWithMetadata): Record<string, unknown> {
+    const keys: Record<string, unknown> = {};
+    for (const [name, metadata] of this.fieldMetadata.entries()) {
+      if (name !== metadata.indexName) continue;
+      const fields: { [field: string]: 1 | -1 } = {};
+      metadata.fields.forEach((field, i) => {
+        fields[field] = metadata.directions?.[i] ?? 1;
+      });
+      keys[name] = this.extractIndexKey(document, fields);
+    }
+    return keys;
+  }
+
   /** Create an index from documents
    * @param documents Documents to index
    * @param fields Fields to index
    * @param indexName Name of the index
+   * @param options Uniqueness and sparseness of the index
    * @returns Index map */
   createIndex(
     documents: T[],
     fields: { [field: string]: 1 | -1 },
-    indexName: string
+    indexName: string,
+    options: { unique?: boolean; sparse?: boolean } = {}
   ): Map<unknown, string[]> {
     const indexMap = new Map<unknown, string[]>();
     const fieldNames = Object.keys(fields);
+    let multikey = false;
 
     for (let i = 0; i < documents.length; i++) {
       const document = documents[i];
       const docWithMetadata = document as T & DocumentWithMetadata;
       const key = this.extractIndexKey(docWithMetadata, fields);
-      let ids = indexMap.get(key);
-      if (!ids) {
-        ids = [];
-        indexMap.set(key, ids);
+      const keys = fieldNames.length === 1 ? this.elementKeys(key) : [key];
+      multikey = multikey || (fieldNames.length === 1 && Array.isArray(key));
+      for (const elementKey of keys) {
+        let ids = indexMap.get(elementKey);
+        if (!ids) {
+          ids = [];
+          indexMap.set(elementKey, ids);
+        }
+        ids.push(docWithMetadata._id);
       }
-      ids.push(docWithMetadata._id);
     }
 
     this.indexes.set(indexName, indexMap);
 
     const metadata: IndexFieldMetadata = {
       fields: fieldNames,
+      directions: fieldNames.map(field => fields[field] ?? 1),
       indexName,
+      unique: options.unique,
+      sparse: options.sparse,
+      multikey,
     };
     this.fieldMetadata.set(indexName, metadata);
 
@@ -9,6 +9,12 @@ interface IndexMetadata {
   sortedEntries?: Array<[any, string[]]>;
 }
 
+/** Collection whose indexes the native resolver should use */
+export interface IndexResolverScope {
+  collection: string;
+  database?: string;
+}
+
 /** Resolves queries using indexes to get candidate document IDs */
 export class IndexQueryResolver {
   private indexMetadata: Map<string, IndexMetadata> = new Map();
@@ -16,7 +22,8 @@ export class IndexQueryResolver {
 
   constructor(
     private indexes: Map<string, Map<any, string[]>>,
-    private fieldMetadata?: Map<string, IndexFieldMetadata>
+    private fieldMetadata?: Map<string, IndexFieldMetadata>,
+    private scope?: IndexResolverScope
   ) {
     this.rebuildFieldMapping().catch(() => {
     });
@@ -29,9 +36,13 @@ export class IndexQueryResolver {
     try {
       // @ts-ignore - Dynamic import for optional native bindings
       const { NativeFilterEngine } = await import('../../native/bindings');
-      if (NativeFilterEngine.isAvailable()) {
+      if (this.scope && NativeFilterEngine.isAvailable()) {
         try {
-          await NativeFilterEngine.rebuildIndexMapping(this.indexes);
+          await NativeFilterEngine.rebuildIndexMapping(
+            this.scope,
+            this.indexes,
+            this.fieldMetadata
+          );
         } catch {
         }
       }
@@ -79,11 +90,14 @@ export class IndexQueryResolver {
     try {
       // @ts-ignore - Dynamic import for optional native bindings
       const { NativeFilterEngine } = await import('../../native/bindings');
-      if (NativeFilterEngine.isAvailable()) {
+      if (this.scope && NativeFilterEngine.isAvailable()) {
         try {
-          const ids = await NativeFilterEngine.getCandidateIds(filter);
-          if (ids) {
-            return new Set(ids);
+          const result = await NativeFilterEngine.getCandidateIds(
+            this.scope,
+            filter
+          );
+          if (result) {
+            return result.ids ? new Set(result.ids) : null;
           }
         } catch {
         }
@@ -187,6 +201,12 @@ export class IndexQueryResolver {
       );
     }
 
+    // Array values are indexed under their elements, so a whole array
+    // cannot be looked up.
+    if (Array.isArray(value)) {
+      return null;
+    }
+
     const ids = index.get(value) || [];
     return new Set(ids);
   }
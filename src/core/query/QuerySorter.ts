@@ -12,10 +12,7 @@ export class QuerySorter<T = Document> {
       const { NativeFilterEngine } = await import('../../native/bindings');
       if (NativeFilterEngine.isAvailable()) {
         try {
-          const sortObj = Array.isArray(sort) 
-            ? Object.fromEntries(sort) 
-            : sort;
-          const result = await NativeFilterEngine.sortDocuments(documents, sortObj);
+          const result = await NativeFilterEngine.sortDocuments(documents, sort);
           return result as T[];
         } catch {
           return this.sortFallback(documents, sort);
@@ -16,6 +16,11 @@ export class FileStorage {
     this.basePath = basePath;
   }
 
+  /** @returns Root directory of this database */
+  getBasePath(): string {
+    return this.basePath;
+  }
+
   /** Ensure a directory exists */
   async ensureDirectory(path: string): Promise<void> {
     if (this.ensuredDirs.has(path)) return;